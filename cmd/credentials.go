@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/cburnette/gather/pkg/gather"
+)
+
+// getCredentials resolves the credentials from the flags, config file and
+// environment, prompting for whatever the devices, or only their jump
+// hosts with jumpHostsOnly, still need when attached to a terminal.
+func getCredentials(devices []gather.Device, options gather.Options, jumpHostsOnly bool) gather.Credentials {
+	var sources []gather.CredentialSource
+	if viper.GetBool("password-stdin") {
+		sources = append(sources, gather.PasswordReader{Reader: os.Stdin})
+	}
+	if passwordFile := viper.GetString("password-file"); passwordFile != "" {
+		sources = append(sources, gather.PasswordFile(passwordFile))
+	}
+	if helper := viper.GetString("credential-helper"); helper != "" {
+		sources = append(sources, gather.CredentialHelper(helper))
+	}
+	sources = append(sources, gather.EnvCredentials{})
+
+	credentials, err := gather.ResolveCredentials(sources...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	interactive := !viper.GetBool("password-stdin") && terminal.IsTerminal(int(os.Stdin.Fd()))
+	logins := getAccounts(devices, credentials, options, jumpHostsOnly)
+
+	// The user is only needed by those with none of their own from the
+	// inventory, --user or the ssh config.
+	needUser := false
+	for _, login := range logins {
+		needUser = needUser || login.user == ""
+	}
+
+	if credentials.User == "" && needUser {
+		if !interactive {
+			log.Fatal("no user given: use --user or $GATHER_USER")
+		}
+
+		fmt.Print("user: ")
+		fmt.Scanf("%s", &credentials.User)
+	}
+
+	// A password is only needed by those without an identity file or
+	// agent to log in with. Unattended, they are left to fail on their
+	// own as long as some device can log in without one.
+	keyAuth, passwordAuth := false, false
+	for _, login := range logins {
+		if len(login.auth.IdentityFiles) > 0 || login.auth.Agent {
+			keyAuth = true
+		} else {
+			passwordAuth = true
+		}
+	}
+
+	if len(credentials.Password) == 0 && passwordAuth {
+		switch {
+		case interactive:
+			fmt.Print("password: ")
+			credentials.Password = readSecret()
+		case !keyAuth:
+			log.Fatal("no password given: use --password-file, --password-stdin, --credential-helper or $GATHER_PASSWORD")
+		}
+	}
+
+	if len(credentials.Passphrase) == 0 {
+		if fn := encryptedIdentityFile(options.Auth, logins); fn != "" {
+			if !interactive {
+				log.Fatalf("%s is encrypted: use --credential-helper or $GATHER_PASSPHRASE", fn)
+			}
+
+			fmt.Printf("passphrase for %s: ", fn)
+			credentials.Passphrase = readSecret()
+		}
+	}
+
+	return credentials
+}
+
+// account is the user and public key authentication a device or jump
+// host is logged in to with; an empty user stands for the run's.
+type account struct {
+	user string
+	auth gather.AuthConfig
+}
+
+// getAccounts returns the accounts of devices, with the ssh config
+// applied, and of the jump hosts they are reached through, or only
+// those of the jump hosts with jumpHostsOnly.
+func getAccounts(devices []gather.Device, credentials gather.Credentials, options gather.Options, jumpHostsOnly bool) []account {
+	resolved, err := gather.NewRunner(devices, nil, credentials, options).ResolvedDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	newAccount := func(user string, auth *gather.AuthConfig) account {
+		a := account{user: user, auth: options.Auth}
+		if a.user == "" {
+			a.user = options.User
+		}
+		if auth != nil {
+			a.auth = *auth
+		}
+		return a
+	}
+
+	var accounts []account
+	for _, device := range resolved {
+		if !jumpHostsOnly {
+			accounts = append(accounts, newAccount(device.User, device.Auth))
+		}
+
+		hops := device.ProxyJump
+		if hops == nil {
+			hops = options.ProxyJump
+		}
+		for _, hop := range hops {
+			accounts = append(accounts, newAccount(hop.User, hop.Auth))
+		}
+	}
+
+	return accounts
+}
+
+// encryptedIdentityFile returns the first identity file of auth, then of
+// logins, that needs a passphrase, or "" if none does. Those of auth must
+// be readable; a device whose own cannot be read fails by itself.
+func encryptedIdentityFile(auth gather.AuthConfig, logins []account) string {
+	checked := make(map[string]bool)
+	check := func(fn string, required bool) bool {
+		if checked[fn] {
+			return false
+		}
+		checked[fn] = true
+
+		encrypted, err := gather.NeedsPassphrase(fn)
+		if err != nil && required {
+			log.Fatal(err)
+		}
+		return encrypted
+	}
+
+	for _, fn := range auth.IdentityFiles {
+		if check(fn, true) {
+			return fn
+		}
+	}
+	for _, login := range logins {
+		for _, fn := range login.auth.IdentityFiles {
+			if check(fn, false) {
+				return fn
+			}
+		}
+	}
+
+	return ""
+}
+
+func readSecret() []byte {
+	secret, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println()
+
+	return secret
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cburnette/gather/knownhostspatched"
+	"github.com/cburnette/gather/pkg/gather"
+)
+
+// keyscanCmd represents the keyscan command
+var keyscanCmd = &cobra.Command{
+	Use:   "keyscan",
+	Short: "Collect the host keys of every device and compare them with known_hosts",
+	Long: `Keyscan connects to every device listed in the inventory, once for each
+host key algorithm, and prints the host keys offered in known_hosts
+format. Each key is preceded by a comment saying whether it matches a
+key in the --known-hosts files, is new, has changed or is revoked,
+followed by the file and line of the known key.
+
+With --write, new keys are appended to the first of the --known-hosts
+files (hashed with --hash-known-hosts). Changed keys are never written.
+Keyscan exits with status 1 if any key has changed or is revoked.
+
+Devices behind jump hosts are scanned through them, which takes logging
+in to the jump hosts; the credentials are then asked for as by run.
+
+For example:
+
+  gather keyscan --devices devices.txt --write`,
+	Run: doKeyscan,
+}
+
+func init() {
+	rootCmd.AddCommand(keyscanCmd)
+
+	keyscanCmd.Flags().Bool("write", false, "append new keys to the known_hosts file")
+}
+
+func doKeyscan(cmd *cobra.Command, args []string) {
+	write, err := cmd.Flags().GetBool("write")
+	if err != nil {
+		panic(err)
+	}
+
+	options := getOptions()
+	devices := getDevices()
+
+	// Only jump hosts are logged in to.
+	var credentials gather.Credentials
+	if needsJumpHosts(devices, options) {
+		credentials = getCredentials(devices, options, true)
+	}
+
+	ctx, stop := notifyContext()
+	defer stop()
+
+	runner := gather.NewRunner(devices, nil, credentials, options)
+	scans, err := runner.ScanHostKeys(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reportSkippedKnownHosts(runner)
+
+	counts := make(map[string]int)
+	for _, scan := range scans {
+		address := scan.Device.DialAddress()
+
+		for _, scanned := range scan.Keys {
+			counts[scanned.Status]++
+
+			fmt.Printf("# %s %s %s %s\n", scan.Device.Name(), scanned.Key.Type(), ssh.FingerprintSHA256(scanned.Key), scanned.Status)
+			for _, known := range scanned.Known {
+				fmt.Printf("#   %s:%d has %s\n", known.Filename, known.Line, ssh.FingerprintSHA256(known.Key))
+			}
+
+			host := knownhostspatched.Normalize(address)
+			if options.HashKnownHosts {
+				host = knownhostspatched.HashHostname(host)
+			}
+			fmt.Println(knownhostspatched.Line([]string{host}, scanned.Key))
+
+			if write && scanned.Status == gather.KeyNew {
+				if err := gather.AddKnownHost(options.KnownHostsFiles[0], address, scanned.Key, options.HashKnownHosts); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		if scan.Err != nil {
+			counts["failed"]++
+			fmt.Fprintf(os.Stderr, "# %s: %v\n", scan.Device.Name(), scan.Err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d devices: %d keys matched, %d new, %d changed, %d revoked, %d devices failed\n",
+		len(scans), counts[gather.KeyMatch], counts[gather.KeyNew], counts[gather.KeyChanged], counts[gather.KeyRevoked], counts["failed"])
+	if write && counts[gather.KeyNew] > 0 {
+		fmt.Fprintf(os.Stderr, "%d new keys written to %s\n", counts[gather.KeyNew], options.KnownHostsFiles[0])
+	}
+
+	if counts[gather.KeyChanged] > 0 || counts[gather.KeyRevoked] > 0 {
+		os.Exit(1)
+	}
+}
+
+// needsJumpHosts reports whether any device is reached through a jump
+// host, given by the inventory, --jump or the ssh config.
+func needsJumpHosts(devices []gather.Device, options gather.Options) bool {
+	for _, device := range devices {
+		if len(device.ProxyJump) > 0 {
+			return true
+		}
+		if device.ProxyJump != nil {
+			continue
+		}
+		if len(options.ProxyJump) > 0 {
+			return true
+		}
+
+		if options.SSHConfig != nil {
+			alias := device.Hostname
+			if alias == "" {
+				alias = device.Address
+			}
+			if jump := options.SSHConfig.Lookup(alias, device.User).ProxyJump; jump != "" && jump != "none" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,26 +3,32 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/mbndr/figlet4go"
 	"github.com/spf13/cobra"
 
+	"github.com/cburnette/gather/pkg/gather"
+
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 )
 
 var (
-	cfgFile        string
-	deviceFile     string
-	commandFile    string
-	outputFile     string
-	knownHostsFile string
-	separator      string
-	debug          bool
+	cfgFile         string
+	deviceFile      string
+	commandFile     string
+	outputFile      string
+	knownHostsFiles []string
+	separator       string
+	debug           bool
 )
 
-const defaultOutputFile = "gather-{timestamp}.txt"
+const defaultOutputFile = "gather-{timestamp}.{format}"
 const defaultKnownHostsFile = "$HOME/.ssh/known_hosts"
+const globalKnownHostsFile = "/etc/ssh/ssh_known_hosts"
+const defaultSSHConfigFile = "$HOME/.ssh/config"
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -61,14 +67,48 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.gather.yaml)")
-	rootCmd.PersistentFlags().StringVar(&deviceFile, "devices", "devices.txt", "path to file containing list of target devices")
+	rootCmd.PersistentFlags().StringVar(&deviceFile, "devices", "devices.txt", "path to inventory of target devices (plain list, YAML, JSON or CSV)")
 	rootCmd.PersistentFlags().StringVar(&commandFile, "commands", "commands.txt", "path to file containing list of commands to run on target devices")
-	rootCmd.PersistentFlags().StringVar(&outputFile, "output", defaultOutputFile, "path to create output file; by default will append timestamp")
-	rootCmd.PersistentFlags().StringVar(&knownHostsFile, "known-hosts", defaultKnownHostsFile, "path to SSH known_hosts file")
+	rootCmd.PersistentFlags().StringVar(&outputFile, "output", defaultOutputFile, "path to create output file; by default named after the timestamp and format")
+	rootCmd.PersistentFlags().StringSliceVar(&knownHostsFiles, "known-hosts", []string{defaultKnownHostsFile, globalKnownHostsFile}, "paths to SSH known_hosts files, read in order; new keys are recorded in the first")
+	rootCmd.PersistentFlags().String("format", gather.FormatText, "output format: text, json or ndjson")
+	rootCmd.PersistentFlags().Bool("nonzero-exit-ok", false, "count commands that exit with a non-zero status as successful in the summary")
 	rootCmd.PersistentFlags().StringVar(&separator, "separator", "|", "separator between host, command and output")
+	rootCmd.PersistentFlags().StringP("user", "u", "", "user to log in as (or $GATHER_USER)")
+	rootCmd.PersistentFlags().String("password-file", "", "read the password from the first line of this file")
+	rootCmd.PersistentFlags().Bool("password-stdin", false, "read the password from the first line of standard input")
+	rootCmd.PersistentFlags().String("credential-helper", "", "command printing username=, password= and passphrase= lines, or just the password")
+	rootCmd.PersistentFlags().StringSlice("identity", nil, "path to a private key file to authenticate with; may be repeated")
+	rootCmd.PersistentFlags().String("certificate", "", "path to an OpenSSH user certificate for one of the identities")
+	rootCmd.PersistentFlags().Bool("agent", false, "authenticate with the keys held by the ssh-agent on SSH_AUTH_SOCK")
+	rootCmd.PersistentFlags().IntP("concurrency", "c", 100, "number of devices to work on at once; 0 for all of them")
+	rootCmd.PersistentFlags().StringSlice("tag-concurrency", nil, "cap devices worked on at once per tag as tag:N, e.g. site=nyc:5, or site:5 for each site")
+	rootCmd.PersistentFlags().Float64("dial-rate", 0, "maximum new connections per second; 0 for no limit")
+	rootCmd.PersistentFlags().Duration("dial-timeout", gather.DefaultDialTimeout, "time allowed to connect to a device, SSH handshake included")
+	rootCmd.PersistentFlags().Int("connection-attempts", 1, "connection attempts per device; failures such as refused connections and timeouts are retried, bad credentials and host keys are not")
+	rootCmd.PersistentFlags().Duration("retry-backoff", gather.DefaultRetryBackoff, "wait before the first retry, doubled before each retry after it")
+	rootCmd.PersistentFlags().Duration("retry-max-backoff", 30*time.Second, "longest wait between connection attempts; 0 for no limit")
+	rootCmd.PersistentFlags().Float64("retry-jitter", 0.2, "shorten each wait between attempts by a random fraction of up to this, from 0 to 1")
+	rootCmd.PersistentFlags().Duration("command-timeout", 0, "time allowed for each command; 0 for no limit (override per command with [timeout=<duration>])")
+	rootCmd.PersistentFlags().Duration("device-timeout", 0, "time allowed for all the work on a single device; 0 for no limit")
+	rootCmd.PersistentFlags().Duration("deadline", 0, "time allowed for the whole run; 0 for no limit")
+	rootCmd.PersistentFlags().Duration("grace-period", 10*time.Second, "time given to running commands to finish after an interrupt")
+	rootCmd.PersistentFlags().String("transport", "", "how to send commands: exec (one channel per command) or shell (one interactive PTY shell); defaults to the platform's, else exec")
+	rootCmd.PersistentFlags().String("platform", "", "platform of devices that do not name one in the inventory, e.g. cisco_ios or juniper_junos")
+	rootCmd.PersistentFlags().String("ssh-config", defaultSSHConfigFile, "OpenSSH client config to take device settings from; \"none\" to ignore it")
+	rootCmd.PersistentFlags().String("proxy", "", "reach devices, or their first jump host, through this proxy: socks5://, socks5h:// or http://[user:password@]host:port")
+	rootCmd.PersistentFlags().StringP("jump", "J", "", "reach devices through these jump hosts, as [user@]host[:port],... like ssh -J")
+	rootCmd.PersistentFlags().StringSlice("algorithms", nil, "algorithm profile to offer in the SSH handshake, e.g. legacy, or platform=profile for one platform's devices; may be repeated")
 	rootCmd.PersistentFlags().BoolP("insecure", "i", false, "insecure mode (ignore host key)")
+	rootCmd.PersistentFlags().Bool("accept-new", false, "trust and record the host keys of hosts not yet in known_hosts; changed keys are still rejected")
+	rootCmd.PersistentFlags().Bool("hash-known-hosts", false, "hash the host names of keys recorded by --accept-new")
+	rootCmd.PersistentFlags().Bool("known-hosts-strict", false, "fail on malformed known_hosts lines instead of skipping them")
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "debug mode (no concurrency, increased logging)")
 
+	for _, name := range []string{"user", "password-file", "password-stdin", "credential-helper"} {
+		viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
+	}
+
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -92,6 +132,8 @@ func initConfig() {
 		viper.SetConfigName(".gather")
 	}
 
+	viper.SetEnvPrefix("gather")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
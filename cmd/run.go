@@ -0,0 +1,581 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/cburnette/gather/pkg/gather"
+)
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run commands on a list of devices and collect the output",
+	Long: `Run connects to every device listed in the inventory over SSH, runs
+every command listed in the commands file and writes each line of output
+to the output file as "host | command | line", or with --format json or
+ndjson as JSON records carrying the device, address, command, stdout,
+stderr, exit status (null when unknown, as with --transport shell),
+error class and timings. In the text format lines
+of standard error are prefixed with "stderr: " and a failed command ends
+with its error. Commands exiting with a non-zero status count as failed
+in the summary unless --nonzero-exit-ok is given. Each device's output is
+written as soon as the device is done, so an interrupted run keeps what
+was collected; once every device is done the file is rewritten in
+inventory order unless --reorder=false is given.
+
+On SIGINT or SIGTERM no further devices or commands are started, running
+commands get --grace-period to finish, everything left undone is recorded
+as cancelled and the partial results are kept.
+
+--dial-timeout, --command-timeout, --device-timeout and --deadline bound
+connecting, each command, each device and the whole run; anything cut
+short is recorded as timed out. A line in the commands file may start
+with [timeout=<duration>] to give that command its own timeout.
+
+--connection-attempts dials a device again when connecting fails in a
+way that may pass: a refused, reset or timed out connection, or one
+dropped during the SSH handshake. Authentication failures, host key
+failures and algorithm mismatches are not retried. Attempts are spaced
+by --retry-backoff, doubling up to --retry-max-backoff and shortened at
+random by up to --retry-jitter, all within --device-timeout. Each
+device's attempts are recorded in the JSON output.
+
+With --transport shell, or transport: shell in the inventory, commands
+are typed one after another into a single interactive shell on a PTY
+and the output is split at each prompt, for devices that reject exec
+requests.
+
+A device's platform, from the inventory or --platform, tells gather how
+to drive its shell: the prompt to wait for, the commands that turn off
+paging, how to answer a "--More--" pager and how to enter enable mode.
+Platforms that need a shell, such as cisco_ios, use it unless a
+transport is given. The enable password is taken from
+$GATHER_ENABLE_PASSWORD or the credential helper's enable_password,
+falling back to the login password.
+Known platforms: ` + strings.Join(gather.PlatformNames(), ", ") + `.
+
+Host keys are checked against the --known-hosts files, by default
+~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts. Those two may be
+missing even when listed explicitly; any other file given must exist. The file and line that vouched for each device's key are
+recorded in JSON output. With --accept-new, a host with no key there has
+the key it offers appended to the first file (hashed with
+--hash-known-hosts) and is trusted from then on; changed keys are still
+rejected. The summary names the hosts that were newly trusted.
+Malformed lines in the known_hosts files are skipped, and listed with
+--debug, unless --known-hosts-strict is given.
+
+The inventory is either a plain list of host[:port] lines or, when the
+file ends in .yaml, .yml, .json or .csv, a structured inventory giving
+each device its own hostname, address, port, username, auth settings,
+platform, group, proxy_jump, algorithms, proxy, tags and vars.
+
+Devices behind bastions are reached through the jump hosts given with
+--jump, like ssh -J, or with proxy_jump per device or per group in the
+inventory. Each jump host is connected to once and shared by every
+device behind it; its host key is checked like a device's, and it may
+set its own username and auth settings in the inventory.
+
+Where management traffic has to go through a proxy, --proxy, or proxy
+per device or per group in the inventory, names a SOCKS5 proxy as
+socks5://[user:password@]host:port (socks5h:// to have the proxy resolve
+host names) or an HTTP proxy supporting CONNECT as http://host:port.
+Devices, or their first jump host, are then connected to through it; a
+proxy of "direct" in the inventory bypasses --proxy.
+
+The algorithms offered in the SSH handshake come from the device's
+algorithms in the inventory, else --algorithms for its platform, else
+--algorithms. The legacy profile adds the SHA-1 Diffie-Hellman key
+exchanges and CBC ciphers old gear may be limited to. A handshake with
+no algorithm in common reports every list that failed to intersect.
+Known algorithm profiles: ` + strings.Join(gather.AlgorithmProfileNames(), ", ") + `.
+
+Settings missing from the inventory are taken from the OpenSSH client
+config given with --ssh-config, by default ~/.ssh/config: the HostName,
+Port, User, IdentityFile and ProxyJump of the Host and Match blocks
+matching each device's hostname, or its address when it has none, with
+Include files followed. Jump hosts are looked up the same way. Values
+set in the inventory, --jump and --user take precedence, and User in
+turn beats a user from the credential helper or the prompt. Identity
+files that are missing, or encrypted with no passphrase given, are
+skipped.
+
+Devices are authenticated with the given identity files, certificate and
+ssh-agent keys, falling back to the password. The user and password are
+taken from --user, --password-stdin, --password-file, --credential-helper
+or the GATHER_USER and GATHER_PASSWORD environment variables, in that
+order, and are only prompted for when none of them supplies one. The
+user is not needed when the inventory or the ssh config names one for
+every device and jump host, nor the password when each has an identity
+file or the agent to log in with, from the flags, the inventory or the
+ssh config.
+
+For example:
+
+  gather run --devices devices.txt --commands commands.txt`,
+	Run: doRun,
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+
+	runCmd.Flags().Bool("reorder", true, "rewrite the output file in inventory order once every device is done")
+}
+
+func doRun(cmd *cobra.Command, args []string) {
+	outputFile, err := rootCmd.PersistentFlags().GetString("output")
+	if err != nil {
+		panic(err)
+	}
+
+	format, err := rootCmd.PersistentFlags().GetString("format")
+	if err != nil {
+		panic(err)
+	}
+
+	if outputFile == defaultOutputFile {
+		extension := format
+		if format == gather.FormatText {
+			extension = "txt"
+		}
+		outputFile = fmt.Sprintf("gather-%s.%s", time.Now().UTC().Format(time.RFC3339), extension)
+	}
+	fmt.Printf("Output File: ")
+	fmt.Printf("%s\n\n", outputFile)
+
+	devices := getDevices()
+	fmt.Printf("Devices:\n")
+	for _, device := range devices {
+		fmt.Println(device.Name())
+	}
+
+	commands := getCommands()
+	fmt.Printf("\nCommands:\n")
+	for _, command := range commands {
+		fmt.Println(command)
+	}
+
+	options := getOptions()
+	fmt.Println()
+
+	credentials := getCredentials(devices, options, false)
+	fmt.Println()
+
+	reorder, err := cmd.Flags().GetBool("reorder")
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, stop := notifyContext()
+	defer stop()
+
+	runner := gather.NewRunner(devices, commands, credentials, options)
+	summary := writeOutputFile(ctx, runner, outputFile, format, reorder)
+
+	fmt.Println()
+	if ctx.Err() != nil {
+		fmt.Println("Interrupted; partial results written to", outputFile)
+	}
+	fmt.Println(summary)
+	reportSkippedKnownHosts(runner)
+}
+
+// reportSkippedKnownHosts points out malformed known_hosts lines that were
+// skipped. In debug mode the runner has already logged each of them.
+func reportSkippedKnownHosts(runner *gather.Runner) {
+	if n := len(runner.KnownHostsSkipped); n > 0 && !runner.Options.Debug {
+		fmt.Fprintf(os.Stderr, "%d malformed known_hosts lines skipped; use --debug to list them or --known-hosts-strict to fail on them\n", n)
+	}
+}
+
+// notifyContext returns a context cancelled by the first SIGINT or
+// SIGTERM. A second signal exits at once.
+func notifyContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("\nReceived %s, finishing running commands; repeat to exit now\n", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		<-signals
+		os.Exit(1)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func getOptions() gather.Options {
+	insecure, err := rootCmd.PersistentFlags().GetBool("insecure")
+	if err != nil {
+		panic(err)
+	}
+
+	acceptNew, err := rootCmd.PersistentFlags().GetBool("accept-new")
+	if err != nil {
+		panic(err)
+	}
+	if acceptNew && insecure {
+		log.Fatal("--accept-new and --insecure cannot be used together")
+	}
+
+	hashKnownHosts, err := rootCmd.PersistentFlags().GetBool("hash-known-hosts")
+	if err != nil {
+		panic(err)
+	}
+
+	knownHostsStrict, err := rootCmd.PersistentFlags().GetBool("known-hosts-strict")
+	if err != nil {
+		panic(err)
+	}
+
+	debug, err := rootCmd.PersistentFlags().GetBool("debug")
+	if err != nil {
+		panic(err)
+	}
+
+	knownHostsFiles, err := rootCmd.PersistentFlags().GetStringSlice("known-hosts")
+	if err != nil {
+		panic(err)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	// The default files are optional wherever they are listed, but the
+	// others given explicitly must exist, except the first when
+	// --accept-new may create it.
+	optional := map[string]bool{
+		home + strings.TrimPrefix(defaultKnownHostsFile, "$HOME"): true,
+		globalKnownHostsFile: true,
+	}
+	for i, file := range knownHostsFiles {
+		if strings.HasPrefix(file, "$HOME") {
+			file = home + strings.TrimPrefix(file, "$HOME")
+			knownHostsFiles[i] = file
+		}
+
+		if _, err := os.Stat(file); os.IsNotExist(err) && !optional[file] && !(i == 0 && acceptNew) {
+			log.Fatal(err)
+		}
+	}
+
+	identityFiles, err := rootCmd.PersistentFlags().GetStringSlice("identity")
+	if err != nil {
+		panic(err)
+	}
+
+	certificate, err := rootCmd.PersistentFlags().GetString("certificate")
+	if err != nil {
+		panic(err)
+	}
+
+	agent, err := rootCmd.PersistentFlags().GetBool("agent")
+	if err != nil {
+		panic(err)
+	}
+
+	concurrency, err := rootCmd.PersistentFlags().GetInt("concurrency")
+	if err != nil {
+		panic(err)
+	}
+
+	tagConcurrency, err := rootCmd.PersistentFlags().GetStringSlice("tag-concurrency")
+	if err != nil {
+		panic(err)
+	}
+
+	dialRate, err := rootCmd.PersistentFlags().GetFloat64("dial-rate")
+	if err != nil {
+		panic(err)
+	}
+
+	dialTimeout, err := rootCmd.PersistentFlags().GetDuration("dial-timeout")
+	if err != nil {
+		panic(err)
+	}
+
+	attempts, err := rootCmd.PersistentFlags().GetInt("connection-attempts")
+	if err != nil {
+		panic(err)
+	}
+	if attempts < 1 {
+		log.Fatalf("invalid --connection-attempts %d: want at least 1", attempts)
+	}
+
+	retryBackoff, err := rootCmd.PersistentFlags().GetDuration("retry-backoff")
+	if err != nil {
+		panic(err)
+	}
+
+	retryMaxBackoff, err := rootCmd.PersistentFlags().GetDuration("retry-max-backoff")
+	if err != nil {
+		panic(err)
+	}
+
+	retryJitter, err := rootCmd.PersistentFlags().GetFloat64("retry-jitter")
+	if err != nil {
+		panic(err)
+	}
+	if retryJitter < 0 || retryJitter > 1 {
+		log.Fatalf("invalid --retry-jitter %g: want 0 to 1", retryJitter)
+	}
+	retry := gather.RetryPolicy{
+		Attempts:   attempts,
+		Backoff:    retryBackoff,
+		MaxBackoff: retryMaxBackoff,
+		Jitter:     retryJitter,
+	}
+
+	commandTimeout, err := rootCmd.PersistentFlags().GetDuration("command-timeout")
+	if err != nil {
+		panic(err)
+	}
+
+	deviceTimeout, err := rootCmd.PersistentFlags().GetDuration("device-timeout")
+	if err != nil {
+		panic(err)
+	}
+
+	deadline, err := rootCmd.PersistentFlags().GetDuration("deadline")
+	if err != nil {
+		panic(err)
+	}
+
+	gracePeriod, err := rootCmd.PersistentFlags().GetDuration("grace-period")
+	if err != nil {
+		panic(err)
+	}
+
+	transport, err := rootCmd.PersistentFlags().GetString("transport")
+	if err != nil {
+		panic(err)
+	}
+
+	platform, err := rootCmd.PersistentFlags().GetString("platform")
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := gather.LookupPlatform(platform); platform != "" && !ok {
+		log.Fatalf("unknown platform %q: want one of %s", platform, strings.Join(gather.PlatformNames(), ", "))
+	}
+
+	algorithmFlags, err := rootCmd.PersistentFlags().GetStringSlice("algorithms")
+	if err != nil {
+		panic(err)
+	}
+	algorithms, platformAlgorithms := parseAlgorithms(algorithmFlags)
+
+	proxy, err := rootCmd.PersistentFlags().GetString("proxy")
+	if err != nil {
+		panic(err)
+	}
+	if proxy != "" {
+		if _, err := gather.NewProxyDialer(proxy, nil); err != nil {
+			log.Fatalf("invalid --proxy: %v", err)
+		}
+	}
+
+	jump, err := rootCmd.PersistentFlags().GetString("jump")
+	if err != nil {
+		panic(err)
+	}
+	proxyJump, err := gather.ParseProxyJump(jump)
+	if err != nil {
+		log.Fatalf("invalid --jump %q: %v", jump, err)
+	}
+
+	sshConfigFile, err := rootCmd.PersistentFlags().GetString("ssh-config")
+	if err != nil {
+		panic(err)
+	}
+
+	var sshConfig *gather.SSHConfig
+	if sshConfigFile != "none" {
+		if strings.HasPrefix(sshConfigFile, "$HOME") {
+			sshConfigFile = home + strings.TrimPrefix(sshConfigFile, "$HOME")
+		}
+		if _, err := os.Stat(sshConfigFile); rootCmd.PersistentFlags().Changed("ssh-config") && os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+
+		sshConfig, err = gather.LoadSSHConfig(sshConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return gather.Options{
+		Transport:      transport,
+		Platform:       platform,
+		DialTimeout:    dialTimeout,
+		Retry:          retry,
+		CommandTimeout: commandTimeout,
+		DeviceTimeout:  deviceTimeout,
+		Deadline:       deadline,
+		GracePeriod:    gracePeriod,
+		Concurrency:    concurrency,
+		TagConcurrency: parseTagConcurrency(tagConcurrency),
+		DialRate:       dialRate,
+		ProxyJump:      proxyJump,
+		Proxy:          proxy,
+		SSHConfig:      sshConfig,
+		User:           viper.GetString("user"),
+		Algorithms:     algorithms,
+		Auth: gather.AuthConfig{
+			IdentityFiles: identityFiles,
+			Certificate:   certificate,
+			Agent:         agent,
+		},
+		PlatformAlgorithms: platformAlgorithms,
+		KnownHostsFiles:    knownHostsFiles,
+		Insecure:           insecure,
+		AcceptNew:          acceptNew,
+		HashKnownHosts:     hashKnownHosts,
+		KnownHostsStrict:   knownHostsStrict,
+		Debug:              debug,
+	}
+}
+
+// parseAlgorithms parses the --algorithms values: a profile for every
+// device, or platform=profile for the devices of one platform.
+func parseAlgorithms(values []string) (gather.Algorithms, map[string]*gather.Algorithms) {
+	var algorithms gather.Algorithms
+	platformAlgorithms := make(map[string]*gather.Algorithms)
+
+	for _, value := range values {
+		platform, profile := "", value
+		if i := strings.Index(value, "="); i != -1 {
+			platform, profile = value[:i], value[i+1:]
+			if _, ok := gather.LookupPlatform(platform); !ok {
+				log.Fatalf("invalid --algorithms %q: unknown platform %q", value, platform)
+			}
+		}
+		if _, ok := gather.LookupAlgorithmProfile(profile); !ok {
+			log.Fatalf("invalid --algorithms %q: want one of %s", value, strings.Join(gather.AlgorithmProfileNames(), ", "))
+		}
+
+		if platform == "" {
+			algorithms.Profile = profile
+		} else {
+			platformAlgorithms[platform] = &gather.Algorithms{Profile: profile}
+		}
+	}
+
+	return algorithms, platformAlgorithms
+}
+
+// parseTagConcurrency parses tag:N limits. The tag itself may contain
+// colons, so the limit is split off at the last one.
+func parseTagConcurrency(values []string) map[string]int {
+	limits := make(map[string]int)
+	for _, value := range values {
+		i := strings.LastIndex(value, ":")
+		if i == -1 {
+			log.Fatalf("invalid tag concurrency %q: want tag:N", value)
+		}
+
+		n, err := strconv.Atoi(value[i+1:])
+		if err != nil || n < 1 {
+			log.Fatalf("invalid tag concurrency %q: want tag:N", value)
+		}
+		limits[value[:i]] = n
+	}
+
+	return limits
+}
+
+// writeOutputFile streams the results of runner to outputFile as each
+// device finishes, then optionally puts the devices back in inventory
+// order.
+func writeOutputFile(ctx context.Context, runner *gather.Runner, outputFile string, format string, reorder bool) *gather.Summary {
+	separator, err := rootCmd.PersistentFlags().GetString("separator")
+	if err != nil {
+		panic(err)
+	}
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer, err := gather.NewFormatWriter(f, format, separator)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nonZeroExitOK, err := rootCmd.PersistentFlags().GetBool("nonzero-exit-ok")
+	if err != nil {
+		panic(err)
+	}
+
+	summary := &gather.Summary{NonZeroExitOK: nonZeroExitOK}
+	err = runner.Stream(ctx, gather.MultiResultWriter(writer, summary))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if reorder {
+		if err := writer.Reorder(outputFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return summary
+}
+
+func getDevices() []gather.Device {
+	deviceFile, err := rootCmd.PersistentFlags().GetString("devices")
+	if err != nil {
+		panic(err)
+	}
+
+	devices, err := gather.LoadInventory(deviceFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return devices
+}
+
+func getCommands() []gather.Command {
+	commandFile, err := rootCmd.PersistentFlags().GetString("commands")
+	if err != nil {
+		panic(err)
+	}
+
+	commands, err := gather.LoadCommands(commandFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return commands
+}
@@ -8,4 +8,6 @@ require (
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.1
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,440 @@
+package knownhostspatched
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKey is a key line of a HostKeyDB.
+type HostKey struct {
+	KnownKey
+
+	// Marker is "@cert-authority", "@revoked" or empty.
+	Marker string
+
+	// Hosts is the comma-separated host pattern list of the line, or
+	// its hashed host.
+	Hosts string
+}
+
+type dbEntry struct {
+	// text is the line as it is written out.
+	text string
+
+	marker string
+	hosts  string
+	// rest is what follows the host patterns: key type, key and comment.
+	rest string
+
+	// key is nil for blank, comment and malformed lines.
+	key     ssh.PublicKey
+	matcher matcher
+
+	// err is why a line is malformed.
+	err error
+}
+
+func parseEntry(text string) dbEntry {
+	e := dbEntry{text: text}
+
+	line := bytes.TrimSpace([]byte(text))
+	if len(line) == 0 || line[0] == '#' {
+		return e
+	}
+
+	marker, hosts, key, err := parseLine(line)
+	if err == nil {
+		if hosts[0] == '|' {
+			e.matcher, err = newHashedHost(hosts)
+		} else {
+			e.matcher, err = newHostnameMatcher(hosts)
+		}
+	}
+	if err != nil {
+		e.err = err
+		return e
+	}
+
+	if marker != "" {
+		_, line = nextWord(line)
+	}
+	_, rest := nextWord(line)
+
+	e.marker = marker
+	e.hosts = hosts
+	e.rest = string(rest)
+	e.key = key
+
+	return e
+}
+
+func (e *dbEntry) format() {
+	e.text = e.hosts + " " + e.rest
+	if e.marker != "" {
+		e.text = e.marker + " " + e.text
+	}
+}
+
+// exactHost reports whether the line names a, as opposed to matching it
+// through a wildcard. Revoked lines name no host.
+func (e *dbEntry) exactHost(a addr) bool {
+	if e.key == nil || e.marker == markerRevoked {
+		return false
+	}
+
+	switch m := e.matcher.(type) {
+	case *hashedHost:
+		return m.match(a)
+	case hostPatterns:
+		if !m.match(a) {
+			return false
+		}
+		for _, p := range m {
+			if !p.negate && p.addr == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropHost removes a from the line's host patterns. It reports whether
+// the line names no other host and should be removed as a whole.
+func (e *dbEntry) dropHost(a addr) bool {
+	if _, ok := e.matcher.(hostPatterns); !ok {
+		return true
+	}
+
+	var kept []string
+	positive := false
+	for _, p := range strings.Split(e.hosts, ",") {
+		m, err := newHostnameMatcher(p)
+		if err != nil || len(m.(hostPatterns)) == 0 {
+			continue
+		}
+
+		hp := m.(hostPatterns)[0]
+		if !hp.negate && hp.addr == a {
+			continue
+		}
+		kept = append(kept, p)
+		positive = positive || !hp.negate
+	}
+
+	if !positive {
+		return true
+	}
+
+	e.hosts = strings.Join(kept, ",")
+	e.matcher, _ = newHostnameMatcher(e.hosts)
+	e.format()
+
+	return false
+}
+
+// HostKeyDB is a known_hosts file held in memory so that it can be
+// queried and changed programmatically. It keeps every line, comments and
+// malformed lines included, in order, and writes back unchanged the lines
+// it did not change.
+type HostKeyDB struct {
+	// Filename is where Save writes the database.
+	Filename string
+
+	entries []dbEntry
+}
+
+// LoadHostKeyDB reads the known_hosts file filename. A missing file gives
+// an empty database that Save creates.
+func LoadHostKeyDB(filename string) (*HostKeyDB, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return &HostKeyDB{Filename: filename}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadHostKeyDB(f, filename)
+}
+
+// ReadHostKeyDB reads a known_hosts file from r. filename is recorded in
+// the keys returned by Lookup and used by Save.
+func ReadHostKeyDB(r io.Reader, filename string) (*HostKeyDB, error) {
+	db := &HostKeyDB{Filename: filename}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		db.entries = append(db.entries, parseEntry(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *HostKeyDB) hostKey(i int) HostKey {
+	e := db.entries[i]
+	return HostKey{
+		KnownKey: KnownKey{
+			Key:      e.key,
+			Filename: db.Filename,
+			Line:     i + 1,
+		},
+		Marker: e.marker,
+		Hosts:  e.hosts,
+	}
+}
+
+// Keys returns every key line in file order.
+func (db *HostKeyDB) Keys() []HostKey {
+	var keys []HostKey
+	for i, e := range db.entries {
+		if e.key != nil {
+			keys = append(keys, db.hostKey(i))
+		}
+	}
+	return keys
+}
+
+// Lookup returns the key lines whose host patterns match address, a host
+// or host:port, in file order. Revoked keys are included with their
+// marker.
+func (db *HostKeyDB) Lookup(address string) []HostKey {
+	a := parseAddr(address)
+
+	var keys []HostKey
+	for i, e := range db.entries {
+		if e.key != nil && e.matcher.match(a) {
+			keys = append(keys, db.hostKey(i))
+		}
+	}
+	return keys
+}
+
+// Skipped returns the malformed lines of the database. They are kept and
+// written back as they are.
+func (db *HostKeyDB) Skipped() []LineError {
+	var skipped []LineError
+	for i, e := range db.entries {
+		if e.err != nil {
+			skipped = append(skipped, LineError{Filename: db.Filename, Line: i + 1, Err: e.err})
+		}
+	}
+	return skipped
+}
+
+// Add appends a line trusting key for addresses. Pass addresses through
+// HashHostname(Normalize(address)) to add a hashed line.
+func (db *HostKeyDB) Add(addresses []string, key ssh.PublicKey) {
+	db.entries = append(db.entries, parseEntry(Line(addresses, key)))
+}
+
+// remove drops address from the lines naming it whose keys keep reports
+// false. It returns the index of the first line affected, or -1, and the
+// number of lines affected.
+func (db *HostKeyDB) remove(address string, keep func(ssh.PublicKey) bool) (int, int) {
+	a := parseAddr(address)
+
+	first, removed := -1, 0
+	entries := db.entries[:0]
+	for _, e := range db.entries {
+		if !e.exactHost(a) || keep(e.key) {
+			entries = append(entries, e)
+			continue
+		}
+
+		if first == -1 {
+			first = len(entries)
+		}
+		removed++
+		if !e.dropHost(a) {
+			entries = append(entries, e)
+		}
+	}
+	db.entries = entries
+
+	return first, removed
+}
+
+// Remove stops trusting any key for address, a host or host:port, like
+// ssh-keygen -R: lines naming only address are deleted and address is
+// taken out of lines naming other hosts too. Lines that only match
+// address through a wildcard are left alone. It returns the number of
+// lines changed.
+func (db *HostKeyDB) Remove(address string) int {
+	_, removed := db.remove(address, func(ssh.PublicKey) bool { return false })
+	return removed
+}
+
+// Replace trusts key for address in place of the keys of the same type
+// the database names it with, keeping keys of other types. The new line
+// takes the place of the first line replaced, or is appended if there
+// was none.
+func (db *HostKeyDB) Replace(address string, key ssh.PublicKey) {
+	first, _ := db.remove(address, func(known ssh.PublicKey) bool {
+		return known.Type() != key.Type()
+	})
+
+	entry := parseEntry(Line([]string{address}, key))
+	if first == -1 {
+		db.entries = append(db.entries, entry)
+		return
+	}
+
+	db.entries = append(db.entries, dbEntry{})
+	copy(db.entries[first+1:], db.entries[first:])
+	db.entries[first] = entry
+}
+
+// Revoke appends an @revoked line for key unless it is already revoked.
+// A revoked key is rejected for every host.
+func (db *HostKeyDB) Revoke(key ssh.PublicKey) {
+	for _, e := range db.entries {
+		if e.marker == markerRevoked && keyEq(e.key, key) {
+			return
+		}
+	}
+
+	db.entries = append(db.entries, parseEntry(markerRevoked+" * "+serialize(key)))
+}
+
+// WriteTo writes the database in known_hosts format.
+func (db *HostKeyDB) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, e := range db.entries {
+		m, err := io.WriteString(w, e.text+"\n")
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// LockHostKeyDB takes an exclusive lock for changing the known_hosts file
+// filename, across processes, and returns the function that releases it.
+// The lock is held on filename with ".lock" added, since Save replaces
+// filename itself. Anything that appends to or rewrites filename should
+// hold it.
+func LockHostKeyDB(filename string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %v", filename, err)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// UpdateHostKeyDB loads the known_hosts file filename, calls update with
+// it and saves the result, all under the lock of LockHostKeyDB, so that no
+// line appended meanwhile is lost. Nothing is written if update fails.
+func UpdateHostKeyDB(filename string, update func(db *HostKeyDB) error) error {
+	unlock, err := LockHostKeyDB(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db, err := LoadHostKeyDB(filename)
+	if err != nil {
+		return err
+	}
+	if err := update(db); err != nil {
+		return err
+	}
+	return db.save()
+}
+
+// Save writes the database back to Filename, replacing the file in one
+// step so that a failed write leaves the old file in place. It holds the
+// lock of LockHostKeyDB while writing, but lines appended since the
+// database was loaded are dropped; UpdateHostKeyDB holds the lock from
+// the load on.
+func (db *HostKeyDB) Save() error {
+	unlock, err := LockHostKeyDB(db.Filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return db.save()
+}
+
+func (db *HostKeyDB) save() error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(db.Filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	dir := filepath.Dir(db.Filename)
+	f, err := ioutil.TempFile(dir, filepath.Base(db.Filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := db.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), db.Filename)
+}
+
+// HostKeyCallback returns a host key callback checking against the
+// database as it is now, for use in ssh.ClientConfig.HostKeyCallback.
+func (db *HostKeyDB) HostKeyCallback() ssh.HostKeyCallback {
+	return db.Checker().HostKeyCallback()
+}
+
+// Checker returns a Checker for the database as it is now.
+func (db *HostKeyDB) Checker() *Checker {
+	hdb := newHostKeyDB()
+	for i, e := range db.entries {
+		if e.key == nil {
+			continue
+		}
+
+		known := db.hostKey(i).KnownKey
+		if e.marker == markerRevoked {
+			hdb.revoked[string(e.key.Marshal())] = &known
+			continue
+		}
+
+		hdb.lines = append(hdb.lines, keyDBLine{
+			cert:     e.marker == markerCert,
+			matcher:  e.matcher,
+			knownKey: known,
+		})
+	}
+
+	return &Checker{db: hdb, Skipped: db.Skipped()}
+}
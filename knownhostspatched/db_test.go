@@ -0,0 +1,302 @@
+package knownhostspatched
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testKey(t *testing.T, ecdsaKey bool) ssh.PublicKey {
+	var pub interface{}
+	if ecdsaKey {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub = &priv.PublicKey
+	} else {
+		var err error
+		pub, _, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readTestDB(t *testing.T, text string) *HostKeyDB {
+	db, err := ReadHostKeyDB(strings.NewReader(text), "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func dbText(t *testing.T, db *HostKeyDB) string {
+	var buf bytes.Buffer
+	if _, err := db.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestHostKeyDBRead(t *testing.T) {
+	k1, k2 := testKey(t, false), testKey(t, true)
+
+	text := "# comment\n" +
+		"router1,10.0.0.1 " + serialize(k1) + " first\n" +
+		"not a key line\n" +
+		"\n" +
+		"[router2]:2222 " + serialize(k2) + "\n" +
+		"*.lab " + serialize(k2) + "\n" +
+		"@revoked * " + serialize(k1) + "\n"
+	db := readTestDB(t, text)
+
+	if got := dbText(t, db); got != text {
+		t.Errorf("WriteTo changed the file:\n%s\nwant\n%s", got, text)
+	}
+
+	if keys := db.Keys(); len(keys) != 4 {
+		t.Errorf("Keys() returned %d keys, want 4", len(keys))
+	}
+
+	skipped := db.Skipped()
+	if len(skipped) != 1 || skipped[0].Line != 3 || skipped[0].Filename != "known_hosts" {
+		t.Errorf("Skipped() = %v, want line 3", skipped)
+	}
+
+	tests := []struct {
+		address string
+		lines   []int
+	}{
+		{"router1", []int{2, 7}},
+		{"10.0.0.1:22", []int{2, 7}},
+		{"router1:2222", nil},
+		{"router2:2222", []int{5}},
+		{"router2", []int{7}},
+		{"core.lab", []int{6, 7}},
+	}
+	for _, test := range tests {
+		var lines []int
+		for _, key := range db.Lookup(test.address) {
+			lines = append(lines, key.Line)
+		}
+		if !equalInts(lines, test.lines) {
+			t.Errorf("Lookup(%q) returned lines %v, want %v", test.address, lines, test.lines)
+		}
+	}
+
+	keys := db.Lookup("router1")
+	if keys[0].Hosts != "router1,10.0.0.1" || keys[0].Marker != "" || !keyEq(keys[0].Key, k1) {
+		t.Errorf("Lookup(router1)[0] = %+v", keys[0])
+	}
+	if keys[1].Marker != markerRevoked {
+		t.Errorf("Lookup(router1)[1].Marker = %q, want %q", keys[1].Marker, markerRevoked)
+	}
+}
+
+func TestHostKeyDBEdit(t *testing.T) {
+	ed1, ed2, ec := testKey(t, false), testKey(t, false), testKey(t, true)
+
+	tests := []struct {
+		name string
+		text string
+		edit func(db *HostKeyDB)
+		want string
+	}{
+		{
+			name: "add",
+			text: "# comment\n",
+			edit: func(db *HostKeyDB) { db.Add([]string{"router1", "[10.0.0.1]:2222"}, ed1) },
+			want: "# comment\nrouter1,[10.0.0.1]:2222 " + serialize(ed1) + "\n",
+		},
+		{
+			name: "remove only host",
+			text: "router1 " + serialize(ed1) + "\nrouter2 " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) {
+				if n := db.Remove("router1"); n != 1 {
+					t.Errorf("remove only host: Remove returned %d, want 1", n)
+				}
+			},
+			want: "router2 " + serialize(ed1) + "\n",
+		},
+		{
+			name: "remove one of several hosts",
+			text: "router1,10.0.0.1,!router9 " + serialize(ed1) + "\n*.lab " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) { db.Remove("10.0.0.1") },
+			want: "router1,!router9 " + serialize(ed1) + "\n*.lab " + serialize(ed1) + "\n",
+		},
+		{
+			name: "remove leaves wildcards",
+			text: "*.lab " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) {
+				if n := db.Remove("core.lab"); n != 0 {
+					t.Errorf("remove leaves wildcards: Remove returned %d, want 0", n)
+				}
+			},
+			want: "*.lab " + serialize(ed1) + "\n",
+		},
+		{
+			name: "replace same type",
+			text: "# comment\nrouter1 " + serialize(ec) + "\nrouter1 " + serialize(ed1) + "\nrouter2 " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) { db.Replace("router1", ed2) },
+			want: "# comment\nrouter1 " + serialize(ec) + "\nrouter1 " + serialize(ed2) + "\nrouter2 " + serialize(ed1) + "\n",
+		},
+		{
+			name: "replace new host",
+			text: "router2 " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) { db.Replace("router1:2222", ed2) },
+			want: "router2 " + serialize(ed1) + "\n[router1]:2222 " + serialize(ed2) + "\n",
+		},
+		{
+			name: "revoke once",
+			text: "router1 " + serialize(ed1) + "\n",
+			edit: func(db *HostKeyDB) {
+				db.Revoke(ed1)
+				db.Revoke(ed1)
+			},
+			want: "router1 " + serialize(ed1) + "\n@revoked * " + serialize(ed1) + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		db := readTestDB(t, test.text)
+		test.edit(db)
+		if got := dbText(t, db); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHostKeyDBHostKeyCallback(t *testing.T) {
+	known, other := testKey(t, false), testKey(t, false)
+
+	db := readTestDB(t, "router1 "+serialize(known)+"\n")
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	if err := db.HostKeyCallback()("router1:22", remote, known); err != nil {
+		t.Errorf("known key: %v", err)
+	}
+
+	err := db.HostKeyCallback()("router1:22", remote, other)
+	if keyErr, ok := err.(*KeyError); !ok || len(keyErr.Want) != 1 {
+		t.Errorf("mismatched key: error = %v, want a *KeyError with one key", err)
+	}
+
+	err = db.HostKeyCallback()("router2:22", remote, known)
+	if keyErr, ok := err.(*KeyError); !ok || len(keyErr.Want) != 0 {
+		t.Errorf("unknown host: error = %v, want a *KeyError with no keys", err)
+	}
+
+	db.Revoke(known)
+	if _, ok := db.HostKeyCallback()("router1:22", remote, known).(*RevokedError); !ok {
+		t.Errorf("revoked key accepted")
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUpdateHostKeyDB(t *testing.T) {
+	key := testKey(t, false)
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(filename, []byte("# team hosts\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends, as --accept-new makes them, race with rewrites; none of
+	// their lines may be lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("router%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			unlock, err := LockHostKeyDB(filename)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+
+			f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			if _, err := f.WriteString(Line([]string{host}, key) + "\n"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := UpdateHostKeyDB(filename, func(db *HostKeyDB) error {
+				db.Replace("[core"+host+"]:2222", key)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	db, err := LoadHostKeyDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		for _, address := range []string{fmt.Sprintf("router%d:22", i), fmt.Sprintf("corerouter%d:2222", i)} {
+			if n := len(db.Lookup(address)); n != 1 {
+				t.Errorf("%s has %d lines, want 1", address, n)
+			}
+		}
+	}
+	if text := dbText(t, db); !strings.HasPrefix(text, "# team hosts\n") || strings.Count(text, "\n") != 41 {
+		t.Errorf("file has %d lines, want the comment and 40 keys:\n%s", strings.Count(text, "\n"), text)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("file mode %v, %v; want it kept at 0640", info.Mode(), err)
+	}
+
+	before, _ := ioutil.ReadFile(filename)
+	failed := errors.New("failed")
+	err = UpdateHostKeyDB(filename, func(db *HostKeyDB) error {
+		db.Revoke(key)
+		return failed
+	})
+	if err != failed {
+		t.Errorf("UpdateHostKeyDB() = %v, want the error of update", err)
+	}
+	if after, _ := ioutil.ReadFile(filename); !bytes.Equal(after, before) {
+		t.Errorf("failed update changed the file")
+	}
+}
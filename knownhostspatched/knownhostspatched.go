@@ -121,6 +121,11 @@ type hostKeyDB struct {
 	// Serialized version of revoked keys
 	revoked map[string]*KnownKey
 	lines   []keyDBLine
+
+	// strict makes Read fail on malformed lines instead of recording
+	// them in skipped.
+	strict  bool
+	skipped []LineError
 }
 
 func newHostKeyDB() *hostKeyDB {
@@ -200,32 +205,12 @@ func parseLine(line []byte) (marker, host string, key ssh.PublicKey, err error)
 	return marker, host, key, nil
 }
 
-func (db *hostKeyDB) parseLine(line []byte, filename string, linenum int, hostWhitelist []string) error {
+func (db *hostKeyDB) parseLine(line []byte, filename string, linenum int, hostWhitelist []addr) error {
 	marker, pattern, key, err := parseLine(line)
 	if err != nil {
-		//return err
-		//added by cburnette
-		//for any error whatsoever simply skip line by returning nil
-		return nil
+		return err
 	}
 
-	//added by cburnette
-	//ignore any hosts that are not in the whitelist
-	allowed := false
-	for _, whitelistHost := range hostWhitelist {
-		if strings.Contains(pattern, whitelistHost) {
-			allowed = true
-			break
-		}
-	}
-
-	if !allowed {
-		//fmt.Printf("rejected host: %s\n", pattern)
-		return nil
-	}
-
-	fmt.Printf("known host: %s\n", pattern)
-
 	if marker == markerRevoked {
 		db.revoked[string(key.Marshal())] = &KnownKey{
 			Key:      key,
@@ -252,9 +237,12 @@ func (db *hostKeyDB) parseLine(line []byte, filename string, linenum int, hostWh
 	}
 
 	if err != nil {
-		//return err
-		//added by cburnette
-		//for any error whatsoever simply skip line by returning nil
+		return err
+	}
+
+	//added by cburnette
+	//ignore any hosts that are not in the whitelist
+	if hostWhitelist != nil && !matchesAny(entry.matcher, hostWhitelist) {
 		return nil
 	}
 
@@ -262,6 +250,39 @@ func (db *hostKeyDB) parseLine(line []byte, filename string, linenum int, hostWh
 	return nil
 }
 
+func matchesAny(m matcher, addrs []addr) bool {
+	for _, a := range addrs {
+		if m.match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWhitelist turns host or host:port whitelist entries into the
+// addresses they are checked as, with port 22 when none is given.
+func parseWhitelist(hosts []string) []addr {
+	if hosts == nil {
+		return nil
+	}
+
+	addrs := make([]addr, 0, len(hosts))
+	for _, h := range hosts {
+		addrs = append(addrs, parseAddr(h))
+	}
+	return addrs
+}
+
+// parseAddr parses a host or host:port, with port 22 when none is given.
+func parseAddr(address string) addr {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		port = "22"
+	}
+	return addr{host, port}
+}
+
 func newHostnameMatcher(pattern string) (matcher, error) {
 	var hps hostPatterns
 	for _, p := range strings.Split(pattern, ",") {
@@ -281,7 +302,10 @@ func newHostnameMatcher(pattern string) (matcher, error) {
 		}
 
 		var err error
-		if p[0] == '[' {
+		if p[0] == '[' && p[len(p)-1] == ']' {
+			a.host = p[1 : len(p)-1]
+			a.port = "22"
+		} else if p[0] == '[' {
 			a.host, a.port, err = net.SplitHostPort(p)
 			if err != nil {
 				return nil, err
@@ -404,8 +428,25 @@ func (db *hostKeyDB) checkAddr(a addr, remoteKey ssh.PublicKey) error {
 	return nil
 }
 
-// The Read function parses file contents.
+// LineError describes a malformed line of a known_hosts file.
+type LineError struct {
+	Filename string
+	Line     int
+	Err      error
+}
+
+func (e *LineError) Error() string {
+	msg := strings.TrimPrefix(e.Err.Error(), "knownhosts: ")
+	return fmt.Sprintf("knownhosts: %s:%d: %s", e.Filename, e.Line, msg)
+}
+
+// The Read function parses file contents. Only lines matching one of the
+// host or host:port entries of hostWhitelist, exactly as OpenSSH would
+// match them, are kept; a nil hostWhitelist keeps every line. Revoked keys
+// are always kept. Malformed lines are skipped, or fail with a *LineError
+// in strict mode.
 func (db *hostKeyDB) Read(r io.Reader, filename string, hostWhitelist []string) error {
+	whitelist := parseWhitelist(hostWhitelist)
 	scanner := bufio.NewScanner(r)
 
 	lineNum := 0
@@ -417,52 +458,127 @@ func (db *hostKeyDB) Read(r io.Reader, filename string, hostWhitelist []string)
 			continue
 		}
 
-		if err := db.parseLine(line, filename, lineNum, hostWhitelist); err != nil {
-			return fmt.Errorf("knownhosts: %s:%d: %v", filename, lineNum, err)
+		if err := db.parseLine(line, filename, lineNum, whitelist); err != nil {
+			lineErr := LineError{Filename: filename, Line: lineNum, Err: err}
+			if db.strict {
+				return &lineErr
+			}
+
+			// Skip the malformed line, but keep track of it.
+			db.skipped = append(db.skipped, lineErr)
 		}
 	}
 	return scanner.Err()
 }
 
 // New creates a host key callback from the given OpenSSH host key
-// files. The returned callback is for use in
+// files, loading only the lines for the hosts in hostWhitelist as
+// described for Read. The returned callback is for use in
 // ssh.ClientConfig.HostKeyCallback. By preference, the key check
 // operates on the hostname if available, i.e. if a server changes its
 // IP address, the host key check will still succeed, even though a
 // record of the new IP address is not available.
 func New(hostWhitelist []string, files ...string) (ssh.HostKeyCallback, error) {
+	checker, err := NewChecker(Config{HostWhitelist: hostWhitelist}, files...)
+	if err != nil {
+		return nil, err
+	}
+	return checker.HostKeyCallback(), nil
+}
+
+// Config controls how NewChecker loads known_hosts files.
+type Config struct {
+	// HostWhitelist limits the lines loaded as described for Read.
+	HostWhitelist []string
+
+	// Strict fails on the first malformed line instead of skipping it.
+	Strict bool
+}
+
+// Checker checks host keys like the callback returned by New, and also
+// tells which known_hosts line vouched for the keys it accepts.
+type Checker struct {
+	db *hostKeyDB
+
+	// Skipped lists the malformed lines skipped when Config.Strict is
+	// not set.
+	Skipped []LineError
+}
+
+// NewChecker loads the given OpenSSH host key files, in order, as
+// config describes.
+func NewChecker(config Config, files ...string) (*Checker, error) {
 	db := newHostKeyDB()
+	db.strict = config.Strict
 	for _, fn := range files {
 		f, err := os.Open(fn)
 		if err != nil {
 			return nil, err
 		}
 		defer f.Close()
-		if err := db.Read(f, fn, hostWhitelist); err != nil {
+		if err := db.Read(f, fn, config.HostWhitelist); err != nil {
 			return nil, err
 		}
 	}
 
+	return &Checker{db: db, Skipped: db.skipped}, nil
+}
+
+// HostKeyCallback returns the checker as a callback for use in
+// ssh.ClientConfig.HostKeyCallback.
+func (c *Checker) HostKeyCallback() ssh.HostKeyCallback {
+	return c.db.callback()
+}
+
+// Check checks key like HostKeyCallback and, if it is accepted, returns
+// the line that vouched for it: the host's key, or for a host
+// certificate the @cert-authority line of its signer.
+func (c *Checker) Check(hostname string, remote net.Addr, key ssh.PublicKey) (*KnownKey, error) {
+	if err := c.db.callback()(hostname, remote, key); err != nil {
+		return nil, err
+	}
+
+	address := hostname
+	if address == "" {
+		address = remote.String()
+	}
+	a := parseAddr(address)
+
+	cert, isCert := key.(*ssh.Certificate)
+	for _, l := range c.db.lines {
+		if l.cert != isCert || !l.match(a) {
+			continue
+		}
+		if (isCert && keyEq(l.knownKey.Key, cert.SignatureKey)) || (!isCert && keyEq(l.knownKey.Key, key)) {
+			known := l.knownKey
+			return &known, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (db *hostKeyDB) callback() ssh.HostKeyCallback {
 	var certChecker ssh.CertChecker
 	certChecker.IsHostAuthority = db.IsHostAuthority
 	certChecker.IsRevoked = db.IsRevoked
 	certChecker.HostKeyFallback = db.check
 
-	return certChecker.CheckHostKey, nil
+	return certChecker.CheckHostKey
 }
 
-// Normalize normalizes an address into the form used in known_hosts
+// Normalize normalizes an address into the form used in known_hosts.
+// Like OpenSSH, hosts on port 22 are written bare, IPv6 literals
+// included, and any other port is written as [host]:port.
 func Normalize(address string) string {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
-		host = address
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
 		port = "22"
 	}
 	entry := host
 	if port != "22" {
 		entry = "[" + entry + "]:" + port
-	} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
-		entry = "[" + entry + "]"
 	}
 	return entry
 }
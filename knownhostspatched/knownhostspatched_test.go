@@ -0,0 +1,88 @@
+package knownhostspatched
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadHostWhitelist(t *testing.T) {
+	hashed := HashHostname(Normalize("10.0.0.1"))
+	hashedPort := HashHostname(Normalize("router1:2222"))
+
+	tests := []struct {
+		hosts     string
+		whitelist string
+		want      bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.1:22", true},
+		{"10.0.0.10", "10.0.0.1", false},
+		{"110.0.0.1", "10.0.0.1", false},
+		{"10.0.0.1", "10.0.0.10", false},
+		{"10.0.0.1", "10.0.0.1:2222", false},
+		{"router1,10.0.0.1", "10.0.0.1", true},
+		{"router10", "router1", false},
+
+		{hashed, "10.0.0.1", true},
+		{hashed, "10.0.0.10", false},
+		{hashed, "10.0.0.1:2222", false},
+		{hashedPort, "router1:2222", true},
+		{hashedPort, "router1", false},
+
+		{"[router1]:2222", "router1:2222", true},
+		{"[router1]:2222", "router1", false},
+		{"[router1]:2222", "router1:22222", false},
+		{"[router1]", "router1", true},
+
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::1", "[2001:db8::1]", true},
+		{"2001:db8::1", "[2001:db8::1]:22", true},
+		{"2001:db8::1", "2001:db8::10", false},
+		{"2001:db8::1", "[2001:db8::1]:2222", false},
+		{"[2001:db8::1]:2222", "[2001:db8::1]:2222", true},
+		{"[2001:db8::1]:2222", "2001:db8::1", false},
+
+		{"*.lab.example.com", "core1.lab.example.com", true},
+		{"*.lab.example.com", "lab.example.com", false},
+		{"10.0.0.?", "10.0.0.5", true},
+		{"10.0.0.?", "10.0.0.50", false},
+		{"*", "anything", true},
+
+		{"*.lab.example.com,!core9.lab.example.com", "core1.lab.example.com", true},
+		{"*.lab.example.com,!core9.lab.example.com", "core9.lab.example.com", false},
+		{"!router1", "router1", false},
+	}
+
+	key := serialize(testKey(t, false))
+	for _, test := range tests {
+		db := newHostKeyDB()
+		if err := db.Read(strings.NewReader(test.hosts+" "+key+"\n"), "known_hosts", []string{test.whitelist}); err != nil {
+			t.Errorf("%q: %v", test.hosts, err)
+			continue
+		}
+		if got := len(db.lines) == 1; got != test.want {
+			t.Errorf("line for %q loaded for whitelist %q: %v, want %v", test.hosts, test.whitelist, got, test.want)
+		}
+	}
+}
+
+func TestReadNoWhitelist(t *testing.T) {
+	key := serialize(testKey(t, false))
+
+	db := newHostKeyDB()
+	text := "10.0.0.1 " + key + "\n[router1]:2222 " + key + "\n*.lab " + key + "\n"
+	if err := db.Read(strings.NewReader(text), "known_hosts", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.lines) != 3 {
+		t.Errorf("%d lines loaded without a whitelist, want 3", len(db.lines))
+	}
+
+	db = newHostKeyDB()
+	if err := db.Read(strings.NewReader(text), "known_hosts", []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.lines) != 0 {
+		t.Errorf("%d lines loaded with an empty whitelist, want 0", len(db.lines))
+	}
+}
@@ -0,0 +1,84 @@
+package gather
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SplitAddress splits a device address into host and port. It accepts
+// host names, IPv4 and IPv6 literals, each optionally followed by a port,
+// with IPv6 literals bracketed when a port is given: "router1",
+// "10.0.0.1:2222", "2001:db8::1", "[2001:db8::1]" and "[2001:db8::1]:2222".
+// The port is zero when the address does not carry one.
+func SplitAddress(address string) (host string, port int, err error) {
+	if address == "" {
+		return "", 0, fmt.Errorf("missing address")
+	}
+
+	if strings.HasPrefix(address, "[") {
+		if strings.HasSuffix(address, "]") {
+			return checkHost(address[1 : len(address)-1])
+		}
+
+		h, p, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", 0, err
+		}
+		return checkHostPort(h, p)
+	}
+
+	switch strings.Count(address, ":") {
+	case 0:
+		return checkHost(address)
+	case 1:
+		h, p, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", 0, err
+		}
+		return checkHostPort(h, p)
+	default:
+		// More than one colon without brackets can only be a bare IPv6
+		// literal; a port would be ambiguous.
+		if ip := net.ParseIP(stripZone(address)); ip == nil {
+			return "", 0, fmt.Errorf("address %s: invalid IPv6 address; use [address]:port to give a port", address)
+		}
+		return address, 0, nil
+	}
+}
+
+// JoinAddress is the inverse of SplitAddress, bracketing IPv6 literals.
+func JoinAddress(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func checkHost(host string) (string, int, error) {
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+	if strings.Contains(host, ":") && net.ParseIP(stripZone(host)) == nil {
+		return "", 0, fmt.Errorf("address %s: invalid IPv6 address", host)
+	}
+	return host, 0, nil
+}
+
+func checkHostPort(host, port string) (string, int, error) {
+	host, _, err := checkHost(host)
+	if err != nil {
+		return "", 0, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", 0, fmt.Errorf("address %s: invalid port %q", JoinAddress(host, 0), port)
+	}
+	return host, p, nil
+}
+
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		return host[:i]
+	}
+	return host
+}
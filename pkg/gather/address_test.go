@@ -0,0 +1,64 @@
+package gather
+
+import "testing"
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		port    int
+		wantErr bool
+	}{
+		{address: "router1", host: "router1"},
+		{address: "router1:2222", host: "router1", port: 2222},
+		{address: "10.0.0.1", host: "10.0.0.1"},
+		{address: "10.0.0.1:22", host: "10.0.0.1", port: 22},
+		{address: "2001:db8::1", host: "2001:db8::1"},
+		{address: "[2001:db8::1]", host: "2001:db8::1"},
+		{address: "[2001:db8::1]:2222", host: "2001:db8::1", port: 2222},
+		{address: "fe80::1%eth0", host: "fe80::1%eth0"},
+		{address: "[fe80::1%eth0]:22", host: "fe80::1%eth0", port: 22},
+		{address: "", wantErr: true},
+		{address: "router1:", wantErr: true},
+		{address: "router1:0", wantErr: true},
+		{address: "router1:65536", wantErr: true},
+		{address: "router1:ssh", wantErr: true},
+		{address: "2001:db8::1:2222:x", wantErr: true},
+		{address: "[]", wantErr: true},
+	}
+
+	for _, test := range tests {
+		host, port, err := SplitAddress(test.address)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("SplitAddress(%q) = %q, %d, want an error", test.address, host, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SplitAddress(%q): %v", test.address, err)
+			continue
+		}
+		if host != test.host || port != test.port {
+			t.Errorf("SplitAddress(%q) = %q, %d, want %q, %d", test.address, host, port, test.host, test.port)
+		}
+	}
+}
+
+func TestDeviceDialAddress(t *testing.T) {
+	tests := []struct {
+		device Device
+		want   string
+	}{
+		{Device{Address: "10.0.0.1"}, "10.0.0.1:22"},
+		{Device{Address: "10.0.0.1", Port: 2222}, "10.0.0.1:2222"},
+		{Device{Address: "2001:db8::1"}, "[2001:db8::1]:22"},
+		{Device{Hostname: "router1"}, "router1:22"},
+	}
+
+	for _, test := range tests {
+		if got := test.device.DialAddress(); got != test.want {
+			t.Errorf("%+v.DialAddress() = %q, want %q", test.device, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package gather
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithms selects the algorithms offered in the SSH handshake, in
+// order of preference. Lists left empty are taken from the named Profile,
+// or DefaultAlgorithmProfile when Profile is empty.
+type Algorithms struct {
+	Profile string `yaml:"profile" json:"profile"`
+
+	Ciphers           []string `yaml:"ciphers" json:"ciphers"`
+	KeyExchanges      []string `yaml:"key_exchanges" json:"key_exchanges"`
+	MACs              []string `yaml:"macs" json:"macs"`
+	HostKeyAlgorithms []string `yaml:"host_key_algorithms" json:"host_key_algorithms"`
+}
+
+func (a *Algorithms) isZero() bool {
+	return a.Profile == "" && len(a.Ciphers) == 0 && len(a.KeyExchanges) == 0 &&
+		len(a.MACs) == 0 && len(a.HostKeyAlgorithms) == 0
+}
+
+// resolve returns the lists a offers, filling those it leaves empty from
+// its profile. Names the SSH library does not implement are rejected,
+// since it would otherwise drop them silently.
+func (a Algorithms) resolve() (Algorithms, error) {
+	name := a.Profile
+	if name == "" {
+		name = DefaultAlgorithmProfile
+	}
+
+	profile, ok := LookupAlgorithmProfile(name)
+	if !ok {
+		return Algorithms{}, fmt.Errorf("unknown algorithm profile %q", name)
+	}
+
+	resolved := Algorithms{Profile: name}
+	for _, list := range []struct {
+		what      string
+		dst       *[]string
+		set, base []string
+		supported map[string]bool
+	}{
+		{"cipher", &resolved.Ciphers, a.Ciphers, profile.Ciphers, supportedCiphers},
+		{"key exchange", &resolved.KeyExchanges, a.KeyExchanges, profile.KeyExchanges, supportedKeyExchanges},
+		{"MAC", &resolved.MACs, a.MACs, profile.MACs, supportedMACs},
+		{"host key algorithm", &resolved.HostKeyAlgorithms, a.HostKeyAlgorithms, profile.HostKeyAlgorithms, supportedHostKeyAlgorithms},
+	} {
+		*list.dst = list.base
+		if len(list.set) > 0 {
+			*list.dst = list.set
+		}
+		for _, algorithm := range *list.dst {
+			if !list.supported[algorithm] {
+				return Algorithms{}, fmt.Errorf("unsupported %s %q", list.what, algorithm)
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// apply sets the algorithms of config to the resolved lists of a.
+func (a Algorithms) apply(config *ssh.ClientConfig) {
+	config.Ciphers = a.Ciphers
+	config.KeyExchanges = a.KeyExchanges
+	config.MACs = a.MACs
+	config.HostKeyAlgorithms = a.HostKeyAlgorithms
+}
+
+// Built-in algorithm profiles.
+const (
+	// DefaultAlgorithmProfile offers what the SSH library offers by
+	// default.
+	DefaultAlgorithmProfile = "default"
+
+	// LegacyAlgorithmProfile adds, after the defaults, the weak
+	// algorithms old network gear may be limited to: the SHA-1
+	// Diffie-Hellman key exchanges and the CBC ciphers.
+	LegacyAlgorithmProfile = "legacy"
+)
+
+var (
+	profilesMutex sync.RWMutex
+	profiles      = make(map[string]Algorithms)
+)
+
+// RegisterAlgorithmProfile adds an algorithm profile, or replaces the one
+// with the same name, so that Algorithms can select it by name. All four
+// lists must be set; the Profile field is ignored.
+func RegisterAlgorithmProfile(name string, algorithms Algorithms) error {
+	if name == "" {
+		return fmt.Errorf("algorithm profile has no name")
+	}
+	if len(algorithms.Ciphers) == 0 || len(algorithms.KeyExchanges) == 0 ||
+		len(algorithms.MACs) == 0 || len(algorithms.HostKeyAlgorithms) == 0 {
+		return fmt.Errorf("algorithm profile %s: every list must be set", name)
+	}
+
+	algorithms.Profile = ""
+
+	profilesMutex.Lock()
+	profiles[name] = algorithms
+	profilesMutex.Unlock()
+
+	return nil
+}
+
+// LookupAlgorithmProfile returns the algorithm profile registered under
+// name.
+func LookupAlgorithmProfile(name string) (Algorithms, bool) {
+	profilesMutex.RLock()
+	defer profilesMutex.RUnlock()
+
+	a, ok := profiles[name]
+	return a, ok
+}
+
+// AlgorithmProfileNames returns the names of every registered algorithm
+// profile in sorted order.
+func AlgorithmProfileNames() []string {
+	profilesMutex.RLock()
+	defer profilesMutex.RUnlock()
+
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// The algorithms implemented by golang.org/x/crypto/ssh.
+var (
+	supportedCiphers = nameSet(
+		"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	)
+	supportedKeyExchanges = nameSet(
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	)
+	supportedMACs = nameSet(
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	)
+	supportedHostKeyAlgorithms = nameSet(defaultHostKeyAlgorithms...)
+)
+
+// defaultHostKeyAlgorithms are the host key algorithms the SSH library
+// offers by default, ssh-dss included.
+var defaultHostKeyAlgorithms = []string{
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+}
+
+func nameSet(names ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+func init() {
+	defaults := Algorithms{
+		Ciphers: []string{
+			"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		},
+		KeyExchanges: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group14-sha1",
+		},
+		MACs:              []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"},
+		HostKeyAlgorithms: defaultHostKeyAlgorithms,
+	}
+
+	legacy := Algorithms{
+		Ciphers: append(append([]string(nil), defaults.Ciphers...), "aes128-cbc", "3des-cbc"),
+		KeyExchanges: append(append([]string(nil), defaults.KeyExchanges...),
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1"),
+		MACs:              defaults.MACs,
+		HostKeyAlgorithms: defaults.HostKeyAlgorithms,
+	}
+
+	for name, algorithms := range map[string]Algorithms{
+		DefaultAlgorithmProfile: defaults,
+		LegacyAlgorithmProfile:  legacy,
+	} {
+		if err := RegisterAlgorithmProfile(name, algorithms); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// algorithms returns the algorithms offered to device: its own, else
+// those set for its platform in Options, else the platform's, else
+// Options.Algorithms.
+func (r *Runner) algorithms(device Device, platform *Platform) (Algorithms, error) {
+	a := r.Options.Algorithms
+	switch {
+	case device.Algorithms != nil:
+		a = *device.Algorithms
+	case r.Options.PlatformAlgorithms[platform.Name] != nil:
+		a = *r.Options.PlatformAlgorithms[platform.Name]
+	case !platform.Algorithms.isZero():
+		a = platform.Algorithms
+	}
+	return a.resolve()
+}
+
+// jumpHostAlgorithms returns the algorithms offered to hop: its own, else
+// Options.Algorithms.
+func (r *Runner) jumpHostAlgorithms(hop JumpHost) (Algorithms, error) {
+	if hop.Algorithms != nil {
+		return hop.Algorithms.resolve()
+	}
+	return r.Options.Algorithms.resolve()
+}
+
+// AlgorithmError reports a handshake that failed because the client and
+// the server have no algorithm in common for one or more of the lists
+// negotiated.
+type AlgorithmError struct {
+	// Mismatches lists every list that failed to intersect, as far as
+	// the server's offer could be read, else the first one the SSH
+	// library reported.
+	Mismatches []AlgorithmMismatch
+
+	Err error
+}
+
+// AlgorithmMismatch is a negotiated list with nothing in common.
+type AlgorithmMismatch struct {
+	// What is "key exchange", "host key", "client to server cipher",
+	// "server to client cipher", "client to server MAC" or "server to
+	// client MAC".
+	What   string
+	Client []string
+	Server []string
+}
+
+func (e *AlgorithmError) Error() string {
+	var parts []string
+	for _, m := range e.Mismatches {
+		parts = append(parts, fmt.Sprintf("no common %s algorithm: offered %v, server offers %v", m.What, m.Client, m.Server))
+	}
+
+	msg := "ssh: handshake failed: " + strings.Join(parts, "; ")
+	if e.legacyWouldWork() {
+		msg += fmt.Sprintf(" (the %s algorithm profile has algorithms in common)", LegacyAlgorithmProfile)
+	}
+	return msg
+}
+
+func (e *AlgorithmError) Unwrap() error {
+	return e.Err
+}
+
+// legacyWouldWork reports whether LegacyAlgorithmProfile intersects every
+// mismatched list.
+func (e *AlgorithmError) legacyWouldWork() bool {
+	legacy, ok := LookupAlgorithmProfile(LegacyAlgorithmProfile)
+	if !ok || len(e.Mismatches) == 0 {
+		return false
+	}
+
+	for _, m := range e.Mismatches {
+		var offered []string
+		switch {
+		case m.What == "key exchange":
+			offered = legacy.KeyExchanges
+		case m.What == "host key":
+			offered = legacy.HostKeyAlgorithms
+		case strings.HasSuffix(m.What, "cipher"):
+			offered = legacy.Ciphers
+		case strings.HasSuffix(m.What, "MAC"):
+			offered = legacy.MACs
+		}
+		if !intersects(offered, m.Server) {
+			return false
+		}
+	}
+	return true
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		if containsString(b, x) {
+			return true
+		}
+	}
+	return false
+}
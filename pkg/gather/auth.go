@@ -0,0 +1,244 @@
+package gather
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AuthConfig selects the public key authentication offered to a device.
+// Password and keyboard-interactive authentication with the run's
+// password are always offered after these as a fallback.
+type AuthConfig struct {
+	// IdentityFiles are private key files in any format understood by
+	// ssh.ParsePrivateKey. Encrypted keys are decrypted with
+	// Credentials.Passphrase. As with OpenSSH, a certificate stored next
+	// to a key as <file>-cert.pub is offered alongside it.
+	IdentityFiles []string `yaml:"identity_files" json:"identity_files"`
+
+	// Certificate is an OpenSSH user certificate for one of the
+	// IdentityFiles or for a key held by the agent.
+	Certificate string `yaml:"certificate" json:"certificate"`
+
+	// Agent offers the keys held by the ssh-agent listening on
+	// SSH_AUTH_SOCK.
+	Agent bool `yaml:"agent" json:"agent"`
+}
+
+// NeedsPassphrase reports whether the private key in the named file is
+// encrypted.
+func NeedsPassphrase(filename string) (bool, error) {
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = ssh.ParsePrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// authenticator hands out the auth methods for each device, loading every
+// identity file and certificate once per run.
+type authenticator struct {
+	credentials Credentials
+	debug       bool
+
+	mutex   sync.Mutex
+	signers map[string][]ssh.Signer
+
+	agentConn net.Conn
+	agent     agent.ExtendedAgent
+}
+
+func newAuthenticator(credentials Credentials, debug bool) *authenticator {
+	return &authenticator{
+		credentials: credentials,
+		debug:       debug,
+		signers:     make(map[string][]ssh.Signer),
+	}
+}
+
+func (a *authenticator) Close() error {
+	if a.agentConn != nil {
+		return a.agentConn.Close()
+	}
+	return nil
+}
+
+// authMethods returns the auth methods for a device using config.
+func (a *authenticator) authMethods(config AuthConfig) ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	for _, fn := range config.IdentityFiles {
+		s, err := a.identitySigners(fn)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s...)
+	}
+
+	if config.Agent {
+		s, err := a.agentSigners()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s...)
+	}
+
+	if config.Certificate != "" {
+		cert, err := loadCertificate(config.Certificate)
+		if err != nil {
+			return nil, err
+		}
+
+		certSigner, err := certSignerFor(cert, signers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.Certificate, err)
+		}
+		signers = append([]ssh.Signer{certSigner}, signers...)
+	}
+
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(a.credentials.Password) > 0 {
+		methods = append(methods,
+			ssh.KeyboardInteractive(a.sshInteractive),
+			ssh.Password(string(a.credentials.Password)),
+		)
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no authentication methods: give a password, identity file or agent")
+	}
+
+	return methods, nil
+}
+
+// identitySigners loads the key in the named file and, if present, the
+// certificate next to it. The certificate signer comes first so that it is
+// tried before the plain key.
+func (a *authenticator) identitySigners(filename string) ([]ssh.Signer, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if signers, ok := a.signers[filename]; ok {
+		return signers, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if len(a.credentials.Passphrase) == 0 {
+			return nil, fmt.Errorf("%s: key is encrypted and no passphrase was given", filename)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, a.credentials.Passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	signers := []ssh.Signer{signer}
+
+	certFile := filename + "-cert.pub"
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := loadCertificate(certFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", certFile, err)
+		}
+		signers = append([]ssh.Signer{certSigner}, signers...)
+	}
+
+	a.signers[filename] = signers
+	return signers, nil
+}
+
+func (a *authenticator) agentSigners() ([]ssh.Signer, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.agent == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("ssh-agent requested but SSH_AUTH_SOCK is not set")
+		}
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent: %v", err)
+		}
+
+		a.agentConn = conn
+		a.agent = agent.NewClient(conn)
+	}
+
+	signers, err := a.agent.Signers()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent: %v", err)
+	}
+
+	return signers, nil
+}
+
+func (a *authenticator) sshInteractive(user, instruction string, questions []string, echos []bool) (answers []string, err error) {
+	answers = make([]string, len(questions))
+	if a.debug {
+		log.Println(questions)
+	}
+	for n := range questions {
+		answers[n] = string(a.credentials.Password)
+	}
+
+	return answers, nil
+}
+
+func loadCertificate(filename string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an OpenSSH certificate", filename)
+	}
+
+	return cert, nil
+}
+
+// certSignerFor pairs cert with the signer holding its private key.
+func certSignerFor(cert *ssh.Certificate, signers []ssh.Signer) (ssh.Signer, error) {
+	want := cert.Key.Marshal()
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), want) {
+			return ssh.NewCertSigner(cert, s)
+		}
+	}
+
+	return nil, fmt.Errorf("no identity file or agent key matches the certificate")
+}
@@ -0,0 +1,194 @@
+package gather
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// CredentialSource supplies credentials without prompting. Fields a
+// source has nothing for are left empty.
+type CredentialSource interface {
+	Credentials() (Credentials, error)
+}
+
+// ResolveCredentials asks every source in turn and keeps the first user,
+// password, passphrase and enable password supplied.
+func ResolveCredentials(sources ...CredentialSource) (Credentials, error) {
+	var resolved Credentials
+	for _, source := range sources {
+		c, err := source.Credentials()
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		if resolved.User == "" {
+			resolved.User = c.User
+		}
+		if len(resolved.Password) == 0 {
+			resolved.Password = c.Password
+		}
+		if len(resolved.Passphrase) == 0 {
+			resolved.Passphrase = c.Passphrase
+		}
+		if len(resolved.EnablePassword) == 0 {
+			resolved.EnablePassword = c.EnablePassword
+		}
+	}
+
+	return resolved, nil
+}
+
+// StaticCredentials supplies fixed credentials.
+type StaticCredentials Credentials
+
+// Credentials implements CredentialSource.
+func (s StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
+
+// Environment variables read by EnvCredentials.
+const (
+	EnvUser           = "GATHER_USER"
+	EnvPassword       = "GATHER_PASSWORD"
+	EnvPassphrase     = "GATHER_PASSPHRASE"
+	EnvEnablePassword = "GATHER_ENABLE_PASSWORD"
+)
+
+// EnvCredentials reads the user, password, passphrase and enable password
+// from the GATHER_USER, GATHER_PASSWORD, GATHER_PASSPHRASE and
+// GATHER_ENABLE_PASSWORD environment variables.
+type EnvCredentials struct{}
+
+// Credentials implements CredentialSource.
+func (EnvCredentials) Credentials() (Credentials, error) {
+	return Credentials{
+		User:           os.Getenv(EnvUser),
+		Password:       []byte(os.Getenv(EnvPassword)),
+		Passphrase:     []byte(os.Getenv(EnvPassphrase)),
+		EnablePassword: []byte(os.Getenv(EnvEnablePassword)),
+	}, nil
+}
+
+// PasswordFile reads the password from the first line of a file.
+type PasswordFile string
+
+// Credentials implements CredentialSource.
+func (p PasswordFile) Credentials() (Credentials, error) {
+	f, err := os.Open(string(p))
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	password, err := readFirstLine(f)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%s: %v", p, err)
+	}
+
+	return Credentials{Password: password}, nil
+}
+
+// PasswordReader reads the password from the first line of a reader,
+// typically os.Stdin fed by a pipe.
+type PasswordReader struct {
+	Reader io.Reader
+}
+
+// Credentials implements CredentialSource.
+func (p PasswordReader) Credentials() (Credentials, error) {
+	password, err := readFirstLine(p.Reader)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("reading password: %v", err)
+	}
+
+	return Credentials{Password: password}, nil
+}
+
+// CredentialHelper runs an external command through the shell and reads
+// credentials from its standard output, either as key=value lines naming
+// username, password, passphrase and enable_password (the format used by
+// git credential helpers) or as a single line holding just the password.
+// A single line is only read as key=value when it starts with one of
+// those keys, so passwords may contain "=".
+type CredentialHelper string
+
+// Credentials implements CredentialSource.
+func (h CredentialHelper) Credentials() (Credentials, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", string(h))
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", string(h))
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("credential helper %q: %v: %s", string(h), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseHelperOutput(out), nil
+}
+
+func parseHelperOutput(out []byte) Credentials {
+	var c Credentials
+
+	lines := strings.Split(strings.TrimRight(string(out), "\r\n"), "\n")
+	if len(lines) == 1 && !isHelperKeyValue(lines[0]) {
+		c.Password = []byte(strings.TrimRight(lines[0], "\r"))
+		return c
+	}
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		i := strings.Index(line, "=")
+		if i == -1 {
+			continue
+		}
+
+		switch key, value := strings.TrimSpace(line[:i]), line[i+1:]; key {
+		case "username", "user":
+			c.User = value
+		case "password":
+			c.Password = []byte(value)
+		case "passphrase":
+			c.Passphrase = []byte(value)
+		case "enable_password":
+			c.EnablePassword = []byte(value)
+		}
+	}
+
+	return c
+}
+
+// helperKeys are the keys parseHelperOutput understands.
+var helperKeys = []string{"username", "user", "password", "passphrase", "enable_password"}
+
+// isHelperKeyValue reports whether line is a key=value line with one of
+// helperKeys.
+func isHelperKeyValue(line string) bool {
+	i := strings.Index(line, "=")
+	return i != -1 && containsString(helperKeys, strings.TrimSpace(line[:i]))
+}
+
+func readFirstLine(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty password")
+	}
+
+	return line, nil
+}
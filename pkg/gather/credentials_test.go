@@ -0,0 +1,34 @@
+package gather
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHelperOutput(t *testing.T) {
+	tests := []struct {
+		out  string
+		want Credentials
+	}{
+		{"secret\n", Credentials{Password: []byte("secret")}},
+		{"secret\r\n", Credentials{Password: []byte("secret")}},
+		{"c2VjcmV0==\n", Credentials{Password: []byte("c2VjcmV0==")}},
+		{"a=b\n", Credentials{Password: []byte("a=b")}},
+		{"password=x==\n", Credentials{Password: []byte("x==")}},
+		{"username=alice\n", Credentials{User: "alice"}},
+		{
+			"user=alice\npassword=p=w\npassphrase=pp\nenable_password=en\n",
+			Credentials{User: "alice", Password: []byte("p=w"), Passphrase: []byte("pp"), EnablePassword: []byte("en")},
+		},
+		{
+			"username=alice\r\n# comment\nunknown=1\npassword=pw\r\n",
+			Credentials{User: "alice", Password: []byte("pw")},
+		},
+	}
+
+	for _, test := range tests {
+		if got := parseHelperOutput([]byte(test.out)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseHelperOutput(%q) = %+v, want %+v", test.out, got, test.want)
+		}
+	}
+}
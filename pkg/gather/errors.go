@@ -0,0 +1,155 @@
+package gather
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+// TimeoutError reports that a dial, command, device or the whole run took
+// longer than it was allowed to.
+type TimeoutError struct {
+	// Scope is one of "dial", "command", "device" or "run".
+	Scope string
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Scope, e.After)
+}
+
+// Kinds of HostKeyError.
+const (
+	HostKeyUnknown  = "unknown"
+	HostKeyMismatch = "mismatch"
+	HostKeyRevoked  = "revoked"
+)
+
+// HostKeyError reports a host key that failed verification against
+// known_hosts, with the key presented and the keys expected.
+type HostKeyError struct {
+	// Kind is HostKeyUnknown, HostKeyMismatch or HostKeyRevoked.
+	Kind string
+
+	// Key is the key the host presented.
+	Key ssh.PublicKey
+
+	// Want holds the keys known_hosts has for the host when Kind is
+	// HostKeyMismatch, or the revoked key when it is HostKeyRevoked.
+	Want []kh.KnownKey
+
+	// Err is the *knownhosts.KeyError or *knownhosts.RevokedError
+	// reported by the check.
+	Err error
+}
+
+func (e *HostKeyError) Error() string {
+	presented := fmt.Sprintf("%s: presented %s", e.Err, fingerprint(e.Key))
+
+	switch e.Kind {
+	case HostKeyMismatch:
+		var want []string
+		for _, known := range e.Want {
+			want = append(want, fmt.Sprintf("%s (%s:%d)", fingerprint(known.Key), known.Filename, known.Line))
+		}
+		return fmt.Sprintf("%s; expected %s", presented, strings.Join(want, ", "))
+	case HostKeyRevoked:
+		revoked := e.Want[0]
+		return fmt.Sprintf("%s, revoked at %s:%d", presented, revoked.Filename, revoked.Line)
+	default:
+		return fmt.Sprintf("%s, not in known_hosts", presented)
+	}
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+func fingerprint(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+// hostKeyError wraps the host key check error err for key in a
+// *HostKeyError, if it is one.
+func hostKeyError(err error, key ssh.PublicKey) error {
+	switch e := err.(type) {
+	case *kh.KeyError:
+		if len(e.Want) == 0 {
+			return &HostKeyError{Kind: HostKeyUnknown, Key: key, Err: err}
+		}
+		return &HostKeyError{Kind: HostKeyMismatch, Key: key, Want: e.Want, Err: err}
+	case *kh.RevokedError:
+		return &HostKeyError{Kind: HostKeyRevoked, Key: key, Want: []kh.KnownKey{e.Revoked}, Err: err}
+	}
+	return err
+}
+
+// Error classes returned by ErrorClass.
+const (
+	ClassDial      = "dial"
+	ClassAuth      = "auth"
+	ClassHostKey   = "hostkey"
+	ClassHandshake = "handshake"
+	ClassSession   = "session"
+	ClassExit      = "exit"
+	ClassTimeout   = "timeout"
+	ClassCancelled = "cancelled"
+	ClassOther     = "other"
+)
+
+// ErrorClass sorts an error recorded in an Output into a broad class so
+// that it can be acted on without parsing its message. It returns "" for
+// a nil error.
+func ErrorClass(err error) string {
+	var (
+		timeout    *TimeoutError
+		keyErr     *kh.KeyError
+		revokedErr *kh.RevokedError
+		exitErr    *ssh.ExitError
+		exitMiss   *ssh.ExitMissingError
+		netErr     net.Error
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &timeout), err == context.DeadlineExceeded:
+		return ClassTimeout
+	case err == context.Canceled:
+		return ClassCancelled
+	case errors.As(err, &keyErr), errors.As(err, &revokedErr):
+		return ClassHostKey
+	case errors.As(err, &exitErr):
+		return ClassExit
+	case errors.As(err, &exitMiss):
+		return ClassSession
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return ClassAuth
+	case strings.HasPrefix(err.Error(), "ssh: handshake failed"):
+		return ClassHandshake
+	case errors.As(err, &netErr):
+		return ClassDial
+	default:
+		return ClassOther
+	}
+}
+
+func errorStatus(err error) string {
+	switch ErrorClass(err) {
+	case "":
+		return StatusOK
+	case ClassTimeout:
+		return StatusTimeout
+	case ClassCancelled:
+		return StatusCancelled
+	default:
+		return StatusError
+	}
+}
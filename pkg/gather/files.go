@@ -0,0 +1,101 @@
+package gather
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReadDevices parses the legacy devices list with one address per line,
+// in any form accepted by SplitAddress. Blank lines and lines starting
+// with # are ignored and the port defaults to 22.
+func ReadDevices(r io.Reader) ([]Device, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	var devices []Device
+
+	i := 0
+	for scanner.Scan() {
+		deviceName := scanner.Text()
+		deviceName = strings.TrimSpace(deviceName)
+
+		if deviceName != "" && !strings.HasPrefix(deviceName, "#") {
+			host, port, err := SplitAddress(deviceName)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+
+			devices = append(devices, Device{
+				ID:      i,
+				Address: host,
+				Port:    port,
+			})
+		}
+		i++
+	}
+
+	return devices, scanner.Err()
+}
+
+// ReadCommands parses a commands list with one command per line. Lines
+// starting with # are ignored. A command may be prefixed with
+// "[timeout=<duration>]" to override the command timeout for it alone,
+// e.g. "[timeout=5m] show tech-support".
+func ReadCommands(r io.Reader) ([]Command, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	var commands []Command
+
+	i := 0
+	for scanner.Scan() {
+		i++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		command, err := parseCommand(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i, err)
+		}
+		commands = append(commands, command)
+	}
+
+	return commands, scanner.Err()
+}
+
+func parseCommand(line string) (Command, error) {
+	const prefix = "[timeout="
+	if !strings.HasPrefix(line, prefix) {
+		return Command{Line: line}, nil
+	}
+
+	end := strings.Index(line, "]")
+	if end == -1 {
+		return Command{}, fmt.Errorf("unterminated %s", prefix)
+	}
+
+	timeout, err := time.ParseDuration(line[len(prefix):end])
+	if err != nil {
+		return Command{}, err
+	}
+
+	return Command{
+		Line:    strings.TrimSpace(line[end+1:]),
+		Timeout: timeout,
+	}, nil
+}
+
+// LoadCommands reads a commands list from the named file.
+func LoadCommands(filename string) ([]Command, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadCommands(f)
+}
@@ -0,0 +1,227 @@
+// Package gather runs a list of commands against a list of devices over
+// SSH and collects the output of every command.
+//
+// It holds the collection engine behind the gather CLI so that other tools
+// can embed it without shelling out to the binary.
+package gather
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+// DefaultPort is the SSH port used when a device does not set one.
+const DefaultPort = 22
+
+// Device is a single target host.
+type Device struct {
+	// ID orders the device within its inventory. Results are sorted by
+	// ID so the output follows the order of the inventory file.
+	ID int
+
+	// Hostname names the device in results. It is also dialed when
+	// Address is empty.
+	Hostname string
+
+	// Address is the host name or IP address the device is dialed on.
+	// IPv6 literals are stored without brackets.
+	Address string
+
+	// Port is the SSH port; zero means DefaultPort.
+	Port int
+
+	// User overrides the user name from the run's credentials.
+	User string
+
+	// Auth overrides the run's public key authentication when set.
+	Auth *AuthConfig
+
+	// Transport overrides Options.Transport when set.
+	Transport string
+
+	// Platform names the kind of device, e.g. cisco_ios or linux.
+	Platform string
+
+	// Group names the inventory group the device belongs to.
+	Group string
+
+	// Proxy overrides Options.Proxy when set; ProxyDirect dials
+	// directly.
+	Proxy string
+
+	// Algorithms overrides the algorithms of the device's platform and
+	// Options when set.
+	Algorithms *Algorithms
+
+	// ProxyJump is the chain of jump hosts the device is reached
+	// through, its own or its group's. Nil means Options.ProxyJump; an
+	// empty, non-nil chain dials the device directly.
+	ProxyJump []JumpHost
+
+	Tags []string
+	Vars map[string]string
+}
+
+// Host returns the host name or IP address the device is dialed on.
+func (d Device) Host() string {
+	if d.Address != "" {
+		return d.Address
+	}
+	return d.Hostname
+}
+
+// DialAddress returns the host:port the device is dialed on.
+func (d Device) DialAddress() string {
+	port := d.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return JoinAddress(d.Host(), port)
+}
+
+// Name returns the name the device is reported under: its hostname if it
+// has one, its dial address otherwise.
+func (d Device) Name() string {
+	if d.Hostname != "" {
+		return d.Hostname
+	}
+	return d.DialAddress()
+}
+
+// Command is a single command to run on every device.
+type Command struct {
+	Line string
+
+	// Timeout overrides Options.CommandTimeout for this command.
+	Timeout time.Duration
+}
+
+func (c Command) String() string {
+	return c.Line
+}
+
+// Output statuses.
+const (
+	StatusOK        = "ok"
+	StatusError     = "error"
+	StatusTimeout   = "timeout"
+	StatusCancelled = "cancelled"
+)
+
+// Output holds what a single command printed on a device, or the error
+// that prevented it from running.
+type Output struct {
+	Command string
+	Stdout  string
+	Stderr  string
+
+	// ExitStatus is the command's remote exit status, or -1 if it did
+	// not report one, as is always the case for commands sent through
+	// TransportShell.
+	ExitStatus int
+
+	// ExitSignal names the signal that killed the command, if any.
+	ExitSignal string
+
+	// Err is why the command failed, if it did.
+	Err    error
+	Status string
+
+	Start time.Time
+	End   time.Time
+}
+
+// ExitedNonZero reports whether the command ran to completion but exited
+// with a non-zero status or was killed by a signal.
+func (o *Output) ExitedNonZero() bool {
+	_, ok := o.Err.(*ssh.ExitError)
+	return ok
+}
+
+// finish records the end of the command and how it went.
+func (o *Output) finish(err error) {
+	o.End = time.Now()
+	o.Err = err
+	o.Status = errorStatus(err)
+
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		o.ExitStatus = exitErr.ExitStatus()
+		o.ExitSignal = exitErr.Signal()
+	}
+}
+
+func errorOutput(command string, err error) Output {
+	output := Output{
+		Command:    command,
+		ExitStatus: -1,
+		Start:      time.Now(),
+	}
+	output.finish(err)
+
+	return output
+}
+
+// Result collects the outputs of every command run on a device.
+type Result struct {
+	Device  Device
+	Outputs []Output
+
+	// KnownHost is the known_hosts line that vouched for the device's
+	// host key, if it was checked and accepted.
+	KnownHost *kh.KnownKey
+
+	// NewHostKey is the host key trusted on first use when connecting to
+	// the device, if Options.AcceptNew added one to known_hosts.
+	NewHostKey ssh.PublicKey
+
+	// NewJumpHostKeys are the host keys of the device's jump hosts
+	// trusted on first use while connecting to it, keyed by jump host
+	// address. A jump host shared by several devices is reported with
+	// the one that connected to it.
+	NewJumpHostKeys map[string]ssh.PublicKey
+
+	// Attempts is the number of times the device was dialed, more than
+	// one when Options.Retry retried failed connections; zero if it was
+	// never dialed.
+	Attempts int
+}
+
+// Status sums up the outputs of a result: cancelled if any command was
+// cancelled, timeout if any command timed out, error if any command
+// failed and ok otherwise.
+func (r *Result) Status() string {
+	return r.status(false)
+}
+
+// status is Status, optionally treating commands that exited non-zero as
+// having succeeded.
+func (r *Result) status(nonZeroExitOK bool) string {
+	status := StatusOK
+	for _, output := range r.Outputs {
+		if nonZeroExitOK && output.ExitedNonZero() {
+			continue
+		}
+
+		switch output.Status {
+		case StatusCancelled:
+			return StatusCancelled
+		case StatusTimeout:
+			status = StatusTimeout
+		case StatusError:
+			if status == StatusOK {
+				status = StatusError
+			}
+		}
+	}
+	return status
+}
+
+// fail records err as the output of every one of commands.
+func (r *Result) fail(commands []Command, err error) {
+	for _, command := range commands {
+		r.Outputs = append(r.Outputs, errorOutput(command.Line, err))
+	}
+}
@@ -0,0 +1,54 @@
+package gather
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSigner returns a fresh ed25519 key to stand for a host or user
+// key.
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startSSHServer listens on a local port and runs the SSH handshake of
+// config with every connection, closing it once the handshake is over.
+// It returns the address listened on.
+func startSSHServer(t *testing.T, config *ssh.ServerConfig) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if c, _, _, err := ssh.NewServerConn(conn, config); err == nil {
+					c.Close()
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
@@ -0,0 +1,328 @@
+package gather
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Inventory file formats understood by ReadInventory.
+const (
+	FormatText = "text"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// inventoryDevice is the YAML and JSON representation of a Device.
+type inventoryDevice struct {
+	Hostname   string            `yaml:"hostname" json:"hostname"`
+	Address    string            `yaml:"address" json:"address"`
+	Port       int               `yaml:"port" json:"port"`
+	Username   string            `yaml:"username" json:"username"`
+	Auth       *AuthConfig       `yaml:"auth" json:"auth"`
+	Platform   string            `yaml:"platform" json:"platform"`
+	Transport  string            `yaml:"transport" json:"transport"`
+	Group      string            `yaml:"group" json:"group"`
+	ProxyJump  []JumpHost        `yaml:"proxy_jump" json:"proxy_jump"`
+	Algorithms *Algorithms       `yaml:"algorithms" json:"algorithms"`
+	Proxy      string            `yaml:"proxy" json:"proxy"`
+	Tags       []string          `yaml:"tags" json:"tags"`
+	Vars       map[string]string `yaml:"vars" json:"vars"`
+}
+
+// inventoryGroup holds the settings shared by the devices of a group.
+type inventoryGroup struct {
+	ProxyJump  []JumpHost  `yaml:"proxy_jump" json:"proxy_jump"`
+	Algorithms *Algorithms `yaml:"algorithms" json:"algorithms"`
+	Proxy      string      `yaml:"proxy" json:"proxy"`
+}
+
+type inventoryFile struct {
+	Groups  map[string]inventoryGroup `yaml:"groups" json:"groups"`
+	Devices []inventoryDevice         `yaml:"devices" json:"devices"`
+}
+
+// InventoryFormat guesses the format of an inventory file from its
+// extension. Anything unrecognised is treated as the legacy text list.
+func InventoryFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	case ".csv":
+		return FormatCSV
+	default:
+		return FormatText
+	}
+}
+
+// LoadInventory reads the devices from the named inventory file, picking
+// the format from its extension.
+func LoadInventory(filename string) ([]Device, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	devices, err := ReadInventory(f, InventoryFormat(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return devices, nil
+}
+
+// ReadInventory parses an inventory in the given format.
+//
+// YAML and JSON inventories hold a "devices" list whose entries carry
+// hostname, address, port, username, auth, platform, transport, group,
+// proxy_jump, algorithms, proxy, tags and vars keys, and an optional
+// "groups" map whose entries set the proxy_jump, algorithms and proxy of
+// the devices in the group that do not set their own. A proxy_jump is a
+// list of jump hosts with address, port, username, auth and algorithms
+// keys; an empty list dials the device directly. An algorithms entry has
+// profile, ciphers, key_exchanges, macs and host_key_algorithms keys. A
+// proxy is a URL as taken by NewProxyDialer, or "direct" to bypass
+// --proxy. Unknown keys are rejected in both formats.
+// CSV inventories start with a header row naming those columns, with
+// the auth settings split into identity_files, certificate and agent
+// columns, proxy_jump written as for ssh -J and algorithms naming a
+// profile; lists are separated by semicolons and any other column
+// becomes a var.
+func ReadInventory(r io.Reader, format string) ([]Device, error) {
+	switch format {
+	case FormatText:
+		return ReadDevices(r)
+	case FormatYAML, FormatJSON:
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var inv inventoryFile
+		if format == FormatYAML {
+			err = yaml.UnmarshalStrict(data, &inv)
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&inv)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return inv.devices()
+	case FormatCSV:
+		return readCSVInventory(r)
+	default:
+		return nil, fmt.Errorf("unknown inventory format %q", format)
+	}
+}
+
+func (inv *inventoryFile) devices() ([]Device, error) {
+	var devices []Device
+	for i, d := range inv.Devices {
+		if d.ProxyJump == nil {
+			d.ProxyJump = inv.Groups[d.Group].ProxyJump
+		}
+		if d.Algorithms == nil {
+			d.Algorithms = inv.Groups[d.Group].Algorithms
+		}
+		if d.Proxy == "" {
+			d.Proxy = inv.Groups[d.Group].Proxy
+		}
+
+		device, err := d.device(i)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+func (d *inventoryDevice) device(id int) (Device, error) {
+	if d.Hostname == "" && d.Address == "" {
+		return Device{}, fmt.Errorf("device %d: hostname or address is required", id+1)
+	}
+
+	if d.Port < 0 || d.Port > 65535 {
+		return Device{}, fmt.Errorf("device %d: invalid port %d", id+1, d.Port)
+	}
+
+	switch d.Transport {
+	case "", TransportExec, TransportShell:
+	default:
+		return Device{}, fmt.Errorf("device %d: unknown transport %q", id+1, d.Transport)
+	}
+
+	address, port := d.Address, d.Port
+	if address != "" {
+		host, p, err := SplitAddress(address)
+		if err != nil {
+			return Device{}, fmt.Errorf("device %d: %v", id+1, err)
+		}
+		if p != 0 && port != 0 && p != port {
+			return Device{}, fmt.Errorf("device %d: address %s conflicts with port %d", id+1, address, port)
+		}
+		if p != 0 {
+			port = p
+		}
+		address = host
+	}
+
+	if d.Algorithms != nil {
+		if _, err := d.Algorithms.resolve(); err != nil {
+			return Device{}, fmt.Errorf("device %d: %v", id+1, err)
+		}
+	}
+
+	if d.Proxy != "" && d.Proxy != ProxyDirect {
+		if _, err := NewProxyDialer(d.Proxy, nil); err != nil {
+			return Device{}, fmt.Errorf("device %d: %v", id+1, err)
+		}
+	}
+
+	var proxyJump []JumpHost
+	if d.ProxyJump != nil {
+		proxyJump = make([]JumpHost, len(d.ProxyJump))
+		for i, hop := range d.ProxyJump {
+			if err := hop.normalize(); err != nil {
+				return Device{}, fmt.Errorf("device %d: %v", id+1, err)
+			}
+			proxyJump[i] = hop
+		}
+	}
+
+	return Device{
+		ID:         id,
+		Hostname:   d.Hostname,
+		Address:    address,
+		Port:       port,
+		User:       d.Username,
+		Auth:       d.Auth,
+		Platform:   d.Platform,
+		Transport:  d.Transport,
+		Group:      d.Group,
+		ProxyJump:  proxyJump,
+		Algorithms: d.Algorithms,
+		Proxy:      d.Proxy,
+		Tags:       d.Tags,
+		Vars:       d.Vars,
+	}, nil
+}
+
+func readCSVInventory(r io.Reader) ([]Device, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	var inv inventoryFile
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var d inventoryDevice
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+
+			switch header[i] {
+			case "hostname":
+				d.Hostname = value
+			case "address":
+				d.Address = value
+			case "port":
+				d.Port, err = strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("device %d: invalid port %q", len(inv.Devices)+1, value)
+				}
+			case "username":
+				d.Username = value
+			case "platform":
+				d.Platform = value
+			case "transport":
+				d.Transport = value
+			case "group":
+				d.Group = value
+			case "proxy":
+				d.Proxy = value
+			case "algorithms":
+				d.Algorithms = &Algorithms{Profile: value}
+			case "proxy_jump":
+				d.ProxyJump, err = ParseProxyJump(value)
+				if err != nil {
+					return nil, fmt.Errorf("device %d: %v", len(inv.Devices)+1, err)
+				}
+			case "identity_files":
+				d.auth().IdentityFiles = splitList(value)
+			case "certificate":
+				d.auth().Certificate = value
+			case "agent":
+				d.auth().Agent, err = strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("device %d: invalid agent %q", len(inv.Devices)+1, value)
+				}
+			case "tags":
+				d.Tags = splitList(value)
+			default:
+				if d.Vars == nil {
+					d.Vars = map[string]string{}
+				}
+				d.Vars[header[i]] = value
+			}
+		}
+		inv.Devices = append(inv.Devices, d)
+	}
+
+	return inv.devices()
+}
+
+func (d *inventoryDevice) auth() *AuthConfig {
+	if d.Auth == nil {
+		d.Auth = &AuthConfig{}
+	}
+	return d.Auth
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
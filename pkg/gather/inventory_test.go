@@ -0,0 +1,180 @@
+package gather
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadInventory(t *testing.T) {
+	want := []Device{
+		{
+			ID:       0,
+			Hostname: "core1",
+			Address:  "10.0.0.1",
+			Port:     2222,
+			User:     "admin",
+			Auth:     &AuthConfig{IdentityFiles: []string{"a.key", "b.key"}, Agent: true},
+			Platform: "cisco_ios",
+			Tags:     []string{"site=nyc", "core"},
+			Vars:     map[string]string{"rack": "r1"},
+		},
+		{
+			ID:        1,
+			Address:   "2001:db8::1",
+			Transport: TransportShell,
+		},
+	}
+
+	inventories := map[string]string{
+		FormatYAML: `
+devices:
+  - hostname: core1
+    address: 10.0.0.1
+    port: 2222
+    username: admin
+    auth:
+      identity_files: [a.key, b.key]
+      agent: true
+    platform: cisco_ios
+    tags: [site=nyc, core]
+    vars:
+      rack: r1
+  - address: "[2001:db8::1]"
+    transport: shell
+`,
+		FormatJSON: `{
+  "devices": [
+    {
+      "hostname": "core1",
+      "address": "10.0.0.1:2222",
+      "username": "admin",
+      "auth": {"identity_files": ["a.key", "b.key"], "agent": true},
+      "platform": "cisco_ios",
+      "tags": ["site=nyc", "core"],
+      "vars": {"rack": "r1"}
+    },
+    {"address": "2001:db8::1", "transport": "shell"}
+  ]
+}`,
+		FormatCSV: `hostname,address,port,username,identity_files,agent,platform,transport,tags,rack
+core1,10.0.0.1,2222,admin,a.key;b.key,true,cisco_ios,,site=nyc;core,r1
+# a comment
+,2001:db8::1,,,,,,shell,,
+`,
+	}
+
+	for format, inventory := range inventories {
+		devices, err := ReadInventory(strings.NewReader(inventory), format)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(devices, want) {
+			t.Errorf("%s: got\n%+v\nwant\n%+v", format, devices, want)
+		}
+	}
+}
+
+func TestReadInventoryText(t *testing.T) {
+	devices, err := ReadInventory(strings.NewReader("# devices\n10.0.0.1\n\nrouter2:2222\n"), FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Device{
+		{ID: 1, Address: "10.0.0.1"},
+		{ID: 3, Address: "router2", Port: 2222},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("got %+v, want %+v", devices, want)
+	}
+}
+
+func TestReadInventoryGroups(t *testing.T) {
+	inventory := `
+groups:
+  dc1:
+    proxy_jump:
+      - address: bastion1
+    algorithms:
+      profile: legacy
+    proxy: socks5://127.0.0.1:1080
+devices:
+  - hostname: a
+    group: dc1
+  - hostname: b
+    group: dc1
+    proxy_jump: []
+    proxy: direct
+  - hostname: c
+`
+	devices, err := ReadInventory(strings.NewReader(inventory), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		jumps   []string
+		direct  bool
+		profile string
+		proxy   string
+	}{
+		{jumps: []string{"bastion1:22"}, profile: LegacyAlgorithmProfile, proxy: "socks5://127.0.0.1:1080"},
+		{direct: true, profile: LegacyAlgorithmProfile, proxy: ProxyDirect},
+		{},
+	}
+	for i, test := range tests {
+		device := devices[i]
+
+		var jumps []string
+		for _, hop := range device.ProxyJump {
+			jumps = append(jumps, hop.DialAddress())
+		}
+		if !reflect.DeepEqual(jumps, test.jumps) {
+			t.Errorf("%s: jump hosts %v, want %v", device.Name(), jumps, test.jumps)
+		}
+		if direct := device.ProxyJump != nil && len(device.ProxyJump) == 0; direct != test.direct {
+			t.Errorf("%s: direct = %v, want %v", device.Name(), direct, test.direct)
+		}
+
+		var profile string
+		if device.Algorithms != nil {
+			profile = device.Algorithms.Profile
+		}
+		if profile != test.profile {
+			t.Errorf("%s: algorithm profile %q, want %q", device.Name(), profile, test.profile)
+		}
+		if device.Proxy != test.proxy {
+			t.Errorf("%s: proxy %q, want %q", device.Name(), device.Proxy, test.proxy)
+		}
+	}
+}
+
+func TestReadInventoryErrors(t *testing.T) {
+	tests := []struct {
+		format    string
+		inventory string
+		wantErr   string
+	}{
+		{FormatYAML, "devices:\n  - adress: 10.0.0.1\n", "adress"},
+		{FormatJSON, `{"devices": [{"adress": "10.0.0.1"}]}`, "adress"},
+		{FormatJSON, `{"devices": [{"address": "10.0.0.1", "auth": {"agnet": true}}]}`, "agnet"},
+		{FormatYAML, "devices:\n  - port: 22\n", "hostname or address is required"},
+		{FormatYAML, "devices:\n  - address: a\n    port: 70000\n", "invalid port"},
+		{FormatYAML, "devices:\n  - address: a:2222\n    port: 22\n", "conflicts with port"},
+		{FormatYAML, "devices:\n  - address: a\n    transport: telnet\n", "unknown transport"},
+		{FormatYAML, "devices:\n  - address: a\n    algorithms: {profile: nope}\n", "unknown algorithm profile"},
+		{FormatYAML, "devices:\n  - address: a\n    proxy: ftp://p:21\n", "unsupported scheme"},
+		{FormatCSV, "address,port\na,x\n", "invalid port"},
+		{FormatCSV, "address,agent\na,maybe\n", "invalid agent"},
+		{"xml", "", "unknown inventory format"},
+	}
+
+	for _, test := range tests {
+		_, err := ReadInventory(strings.NewReader(test.inventory), test.format)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s %q: error = %v, want %q", test.format, test.inventory, err, test.wantErr)
+		}
+	}
+}
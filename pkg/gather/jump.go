@@ -0,0 +1,356 @@
+package gather
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHost is a bastion that connections are tunnelled through, like an
+// entry of OpenSSH's ProxyJump. Each jump host is authenticated and has
+// its host key checked in its own right.
+type JumpHost struct {
+	// Address is the host name or IP address of the jump host, with an
+	// optional :port.
+	Address string `yaml:"address" json:"address"`
+
+	// Port is the SSH port; zero means DefaultPort.
+	Port int `yaml:"port" json:"port"`
+
+	// User overrides the user name from the run's credentials.
+	User string `yaml:"username" json:"username"`
+
+	// Auth overrides the run's public key authentication when set.
+	Auth *AuthConfig `yaml:"auth" json:"auth"`
+
+	// Algorithms overrides Options.Algorithms when set.
+	Algorithms *Algorithms `yaml:"algorithms" json:"algorithms"`
+}
+
+// DialAddress returns the host:port the jump host is dialed on.
+func (j JumpHost) DialAddress() string {
+	port := j.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return JoinAddress(j.Address, port)
+}
+
+func (j JumpHost) String() string {
+	if j.User != "" {
+		return j.User + "@" + j.DialAddress()
+	}
+	return j.DialAddress()
+}
+
+// normalize moves a port given in Address into Port and checks the
+// jump host's algorithms.
+func (j *JumpHost) normalize() error {
+	if j.Address == "" {
+		return fmt.Errorf("jump host address is required")
+	}
+
+	host, port, err := SplitAddress(j.Address)
+	if err != nil {
+		return err
+	}
+	if port != 0 && j.Port != 0 && port != j.Port {
+		return fmt.Errorf("jump host %s conflicts with port %d", j.Address, j.Port)
+	}
+	if port != 0 {
+		j.Port = port
+	}
+	j.Address = host
+
+	if j.Algorithms != nil {
+		if _, err := j.Algorithms.resolve(); err != nil {
+			return fmt.Errorf("jump host %s: %v", j.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// ParseProxyJump parses a comma-separated list of [user@]host[:port]
+// jump hosts, as given to ssh -J, in the order they are hopped through.
+func ParseProxyJump(s string) ([]JumpHost, error) {
+	var hops []JumpHost
+	for _, hop := range strings.Split(s, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+
+		var j JumpHost
+		if i := strings.LastIndex(hop, "@"); i != -1 {
+			j.User, hop = hop[:i], hop[i+1:]
+		}
+		j.Address = hop
+
+		if err := j.normalize(); err != nil {
+			return nil, err
+		}
+		hops = append(hops, j)
+	}
+
+	return hops, nil
+}
+
+// dialFunc opens a network connection to address.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func directDialer(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// clientDialer opens connections tunnelled through client.
+func clientDialer(client *ssh.Client) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		type dialed struct {
+			conn net.Conn
+			err  error
+		}
+
+		done := make(chan dialed, 1)
+		go func() {
+			conn, err := client.Dial(network, address)
+			done <- dialed{conn, err}
+		}()
+
+		select {
+		case d := <-done:
+			return d.conn, d.err
+		case <-ctx.Done():
+			go func() {
+				if d := <-done; d.conn != nil {
+					d.conn.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// jumpConn is a connection to a jump host shared by every device behind
+// it. ready is closed once client or err is set.
+type jumpConn struct {
+	ready  chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// jumpPool keeps one connection per chain of jump hosts for the length
+// of a run, or until the jump host drops it.
+type jumpPool struct {
+	mutex sync.Mutex
+	conns map[string]*jumpConn
+	order []*jumpConn
+}
+
+func newJumpPool() *jumpPool {
+	return &jumpPool{conns: make(map[string]*jumpConn)}
+}
+
+// get returns the connection for key, calling dial to open it if no other
+// device has. A failed dial is not kept, so the next device tries again.
+func (p *jumpPool) get(ctx context.Context, key string, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	for {
+		p.mutex.Lock()
+		conn, ok := p.conns[key]
+		if !ok {
+			conn = &jumpConn{ready: make(chan struct{})}
+			p.conns[key] = conn
+		}
+		p.mutex.Unlock()
+
+		if !ok {
+			return p.dial(key, conn, dial)
+		}
+
+		select {
+		case <-conn.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// The device that dialed may have given up on its own
+		// deadline; that is no reason for this one to fail.
+		if conn.err == context.Canceled || conn.err == context.DeadlineExceeded {
+			continue
+		}
+		return conn.client, conn.err
+	}
+}
+
+func (p *jumpPool) dial(key string, conn *jumpConn, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	conn.client, conn.err = dial()
+
+	p.mutex.Lock()
+	if conn.err != nil {
+		delete(p.conns, key)
+	} else {
+		p.order = append(p.order, conn)
+		go p.evict(key, conn)
+	}
+	p.mutex.Unlock()
+	close(conn.ready)
+
+	return conn.client, conn.err
+}
+
+// evict forgets the connection to a jump host once it ends, whether the
+// jump host dropped it or Close closed it, so that the next device behind
+// it connects to the jump host again.
+func (p *jumpPool) evict(key string, conn *jumpConn) {
+	conn.client.Wait()
+	p.forget(key, conn.client)
+}
+
+func (p *jumpPool) forget(key string, client *ssh.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if conn, ok := p.conns[key]; ok && conn.client == client {
+		delete(p.conns, key)
+	}
+	for i, conn := range p.order {
+		if conn.client == client {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// dialer returns how to open connections through client, the connection
+// kept for key. A client that fails to open a channel for any reason but
+// the jump host refusing it is closed and forgotten straight away, as its
+// connection is gone even if evict has yet to notice.
+func (p *jumpPool) dialer(key string, client *ssh.Client) dialFunc {
+	dial := clientDialer(client)
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		var openErr *ssh.OpenChannelError
+		if err != nil && ctx.Err() == nil && !errors.As(err, &openErr) {
+			client.Close()
+			p.forget(key, client)
+		}
+		return conn, err
+	}
+}
+
+// Close closes every jump host connection, innermost first.
+func (p *jumpPool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i := len(p.order) - 1; i >= 0; i-- {
+		p.order[i].client.Close()
+	}
+	p.order = nil
+	p.conns = make(map[string]*jumpConn)
+}
+
+// proxyJump returns the jump hosts device is reached through.
+func (r *Runner) proxyJump(device Device) []JumpHost {
+	if device.ProxyJump != nil {
+		return device.ProxyJump
+	}
+	return r.Options.ProxyJump
+}
+
+// deviceDialer returns how to open connections to device: directly or
+// through its proxy, and through its jump hosts, connecting to those as
+// needed. trusted, if not nil, is called with the address and key of
+// every jump host trusted on first use while connecting to them.
+func (r *Runner) deviceDialer(ctx context.Context, device Device, sshConfig *ssh.ClientConfig, auth *authenticator, trusted func(string, ssh.PublicKey)) (dialFunc, error) {
+	dial, proxyKey, err := r.proxyDialer(device)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := r.proxyJump(device)
+	key := []string{proxyKey}
+	for _, hop := range hops {
+		key = append(key, hop.String())
+
+		hop, through := hop, dial
+		poolKey := strings.Join(key, ",")
+		client, err := r.jumps.get(ctx, poolKey, func() (*ssh.Client, error) {
+			return r.connectToJumpHost(ctx, hop, through, sshConfig, auth, trusted)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("jump host %s: %w", hop.DialAddress(), err)
+		}
+
+		dial = r.jumps.dialer(poolKey, client)
+	}
+
+	return dial, nil
+}
+
+func (r *Runner) connectToJumpHost(ctx context.Context, hop JumpHost, dial dialFunc, sshConfig *ssh.ClientConfig, auth *authenticator, trusted func(string, ssh.PublicKey)) (*ssh.Client, error) {
+	config := *sshConfig
+	if r.knownHosts != nil {
+		config.HostKeyCallback = r.knownHosts.acceptNew(config.HostKeyCallback, func(key ssh.PublicKey) {
+			if trusted != nil {
+				trusted(hop.DialAddress(), key)
+			}
+		})
+	}
+	if hop.User != "" {
+		config.User = hop.User
+	}
+
+	algorithms, err := r.jumpHostAlgorithms(hop)
+	if err != nil {
+		return nil, err
+	}
+	algorithms.apply(&config)
+
+	authConfig := r.Options.Auth
+	if hop.Auth != nil {
+		authConfig = *hop.Auth
+	}
+
+	config.Auth, err = auth.authMethods(authConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return connectToDevice(ctx, hop.DialAddress(), dial, &config)
+}
+
+// jumpHostAddresses returns the dial addresses of every jump host of the
+// run, which need their known_hosts lines loaded like devices do.
+func (r *Runner) jumpHostAddresses() []string {
+	var addresses []string
+	seen := make(map[string]bool)
+	add := func(hops []JumpHost) {
+		for _, hop := range hops {
+			if address := hop.DialAddress(); !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	add(r.Options.ProxyJump)
+	for _, device := range r.devices {
+		add(device.ProxyJump)
+	}
+
+	return addresses
+}
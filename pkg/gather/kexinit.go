@@ -0,0 +1,134 @@
+package gather
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxKexInitRecord bounds what kexInitRecorder keeps of the start of a
+// connection; the server's version line and KEXINIT fit well within it.
+const maxKexInitRecord = 64 * 1024
+
+const msgKexInit = 20
+
+// kexInitRecorder keeps the first bytes read from a connection so that
+// the server's KEXINIT, which is sent in the clear, can be read back if
+// the handshake fails.
+type kexInitRecorder struct {
+	net.Conn
+
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (c *kexInitRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mutex.Lock()
+	if room := maxKexInitRecord - c.buf.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		c.buf.Write(p[:room])
+	}
+	c.mutex.Unlock()
+
+	return n, err
+}
+
+// serverAlgorithms returns the algorithm name-lists of the server's
+// KEXINIT: key exchange, host key, ciphers and MACs in each direction.
+// It returns nil if they could not be read.
+func (c *kexInitRecorder) serverAlgorithms() [][]string {
+	c.mutex.Lock()
+	data := append([]byte(nil), c.buf.Bytes()...)
+	c.mutex.Unlock()
+
+	// The server may send other lines before its version line.
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			return nil
+		}
+		line := data[:i]
+		data = data[i+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	if len(data) < 6 {
+		return nil
+	}
+	length := binary.BigEndian.Uint32(data)
+	padding := int(data[4])
+	if uint64(length) > uint64(len(data)-4) || int(length) < padding+1 {
+		return nil
+	}
+	payload := data[5 : 4+int(length)-padding]
+
+	// Skip the message number and the 16 byte cookie.
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil
+	}
+	payload = payload[17:]
+
+	var lists [][]string
+	for len(lists) < 6 {
+		if len(payload) < 4 {
+			return nil
+		}
+		n := binary.BigEndian.Uint32(payload)
+		if uint64(n) > uint64(len(payload)-4) {
+			return nil
+		}
+		lists = append(lists, strings.Split(string(payload[4:4+n]), ","))
+		payload = payload[4+n:]
+	}
+
+	return lists
+}
+
+var noCommonAlgorithm = regexp.MustCompile(`no common algorithm for (.+); client offered: \[(.*)\], server offered: \[(.*)\]`)
+
+// algorithmError turns the "no common algorithm" handshake error err
+// into an *AlgorithmError listing every list offered in config that does
+// not intersect the server's. It returns err unchanged for other errors.
+func algorithmError(err error, config *ssh.ClientConfig, recorder *kexInitRecorder) error {
+	m := noCommonAlgorithm.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+
+	algErr := &AlgorithmError{Err: err}
+
+	if server := recorder.serverAlgorithms(); server != nil {
+		for i, list := range []struct {
+			what   string
+			client []string
+		}{
+			{"key exchange", config.KeyExchanges},
+			{"host key", config.HostKeyAlgorithms},
+			{"client to server cipher", config.Ciphers},
+			{"server to client cipher", config.Ciphers},
+			{"client to server MAC", config.MACs},
+			{"server to client MAC", config.MACs},
+		} {
+			if !intersects(list.client, server[i]) {
+				algErr.Mismatches = append(algErr.Mismatches, AlgorithmMismatch{What: list.what, Client: list.client, Server: server[i]})
+			}
+		}
+	}
+
+	if len(algErr.Mismatches) == 0 {
+		algErr.Mismatches = []AlgorithmMismatch{{What: m[1], Client: strings.Fields(m[2]), Server: strings.Fields(m[3])}}
+	}
+
+	return algErr
+}
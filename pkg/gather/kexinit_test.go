@@ -0,0 +1,197 @@
+package gather
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startLegacySSHServer starts an SSH server limited to the SHA-1
+// Diffie-Hellman key exchange and a CBC cipher, as old gear is.
+func startLegacySSHServer(t *testing.T) string {
+	config := &ssh.ServerConfig{
+		Config: ssh.Config{
+			KeyExchanges: []string{"diffie-hellman-group1-sha1"},
+			Ciphers:      []string{"aes128-cbc"},
+		},
+		NoClientAuth: true,
+	}
+	config.AddHostKey(newTestSigner(t))
+
+	return startSSHServer(t, config)
+}
+
+func connectWithProfile(t *testing.T, address, profile string) error {
+	algorithms, err := Algorithms{Profile: profile}.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            "admin",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	algorithms.apply(config)
+
+	client, err := connectToDevice(context.Background(), address, directDialer, config)
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+func TestAlgorithmError(t *testing.T) {
+	address := startLegacySSHServer(t)
+
+	err := connectWithProfile(t, address, DefaultAlgorithmProfile)
+	var algErr *AlgorithmError
+	if !errors.As(err, &algErr) {
+		t.Fatalf("connecting with the default profile: error = %v, want an *AlgorithmError", err)
+	}
+
+	var what []string
+	for _, m := range algErr.Mismatches {
+		what = append(what, m.What)
+		if len(m.Client) == 0 || len(m.Server) == 0 {
+			t.Errorf("%s mismatch is missing an offer: %+v", m.What, m)
+		}
+	}
+	want := []string{"key exchange", "client to server cipher", "server to client cipher"}
+	if !reflect.DeepEqual(what, want) {
+		t.Errorf("mismatched lists %v, want %v", what, want)
+	}
+	if server := algErr.Mismatches[0].Server; !reflect.DeepEqual(server, []string{"diffie-hellman-group1-sha1"}) {
+		t.Errorf("server key exchanges %v, want [diffie-hellman-group1-sha1]", server)
+	}
+	if !strings.Contains(err.Error(), "the legacy algorithm profile has algorithms in common") {
+		t.Errorf("error %q does not suggest the legacy profile", err)
+	}
+	if Retryable(err) {
+		t.Errorf("algorithm mismatch is retryable")
+	}
+
+	if err := connectWithProfile(t, address, LegacyAlgorithmProfile); err != nil {
+		t.Errorf("connecting with the legacy profile: %v", err)
+	}
+}
+
+// kexInitPacket returns a banner line and a server version line followed
+// by a KEXINIT packet offering lists.
+func kexInitPacket(lists [][]string) []byte {
+	var payload bytes.Buffer
+	payload.WriteByte(msgKexInit)
+	payload.Write(make([]byte, 16))
+	for _, list := range lists {
+		binary.Write(&payload, binary.BigEndian, uint32(len(strings.Join(list, ","))))
+		payload.WriteString(strings.Join(list, ","))
+	}
+	payload.Write([]byte{0, 0, 0, 0, 0})
+
+	padding := 8 - (payload.Len()+5)%8
+	if padding < 4 {
+		padding += 8
+	}
+
+	var packet bytes.Buffer
+	packet.WriteString("Welcome\r\nSSH-2.0-Router_1.0\r\n")
+	binary.Write(&packet, binary.BigEndian, uint32(1+payload.Len()+padding))
+	packet.WriteByte(byte(padding))
+	packet.Write(payload.Bytes())
+	packet.Write(make([]byte, padding))
+	return packet.Bytes()
+}
+
+func recorderWith(data []byte) *kexInitRecorder {
+	r := &kexInitRecorder{}
+	r.buf.Write(data)
+	return r
+}
+
+func TestServerAlgorithms(t *testing.T) {
+	lists := [][]string{
+		{"diffie-hellman-group1-sha1"},
+		{"ssh-rsa"},
+		{"aes128-cbc", "3des-cbc"},
+		{"aes128-cbc"},
+		{"hmac-sha1"},
+		{"hmac-sha1"},
+		{""},
+		{""},
+		{""},
+		{""},
+	}
+	packet := kexInitPacket(lists)
+
+	if got := recorderWith(packet).serverAlgorithms(); !reflect.DeepEqual(got, lists[:6]) {
+		t.Errorf("serverAlgorithms() = %v, want %v", got, lists[:6])
+	}
+
+	// Every prefix cut short of the six lists must be rejected.
+	end := bytes.Index(packet, []byte("hmac-sha1hmac")) + 9
+	for i := 0; i < len(packet); i++ {
+		got := recorderWith(packet[:i]).serverAlgorithms()
+		if i < end && got != nil {
+			t.Errorf("serverAlgorithms() of the first %d bytes = %v, want nil", i, got)
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no version line", []byte("garbage without a newline")},
+		{"version only", []byte("SSH-2.0-Router\r\n")},
+		{"huge length", append([]byte("SSH-2.0-Router\r\n"), 0xff, 0xff, 0xff, 0xff, 4, 20)},
+		{"padding beyond length", append([]byte("SSH-2.0-Router\r\n"), 0, 0, 0, 8, 200, 20, 0, 0, 0, 0, 0, 0)},
+		{"not a KEXINIT", append([]byte("SSH-2.0-Router\r\n"), 0, 0, 0, 24, 4, 21, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+	for _, test := range tests {
+		if got := recorderWith(test.data).serverAlgorithms(); got != nil {
+			t.Errorf("%s: serverAlgorithms() = %v, want nil", test.name, got)
+		}
+	}
+
+	// Random damage must never panic.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := append([]byte(nil), packet...)
+		for j := 0; j < 1+rng.Intn(4); j++ {
+			data[rng.Intn(len(data))] = byte(rng.Intn(256))
+		}
+		recorderWith(data[:rng.Intn(len(data)+1)]).serverAlgorithms()
+	}
+}
+
+func TestAlgorithmErrorFallback(t *testing.T) {
+	config := &ssh.ClientConfig{
+		Config: ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256"},
+			Ciphers:      []string{"aes128-ctr"},
+			MACs:         []string{"hmac-sha2-256"},
+		},
+		HostKeyAlgorithms: []string{"ssh-ed25519"},
+	}
+	handshakeErr := errors.New("ssh: handshake failed: ssh: no common algorithm for key exchange; client offered: [curve25519-sha256], server offered: [diffie-hellman-group1-sha1]")
+
+	// Without the server's KEXINIT only the reported list is known.
+	err := algorithmError(handshakeErr, config, recorderWith([]byte("SSH-2.0-Router\r\ngarbage")))
+	want := []AlgorithmMismatch{{What: "key exchange", Client: []string{"curve25519-sha256"}, Server: []string{"diffie-hellman-group1-sha1"}}}
+	if algErr, ok := err.(*AlgorithmError); !ok || !reflect.DeepEqual(algErr.Mismatches, want) {
+		t.Errorf("algorithmError() = %#v, want mismatches %+v", err, want)
+	}
+
+	other := errors.New("ssh: handshake failed: ssh: unable to authenticate")
+	if err := algorithmError(other, config, recorderWith(nil)); err != other {
+		t.Errorf("algorithmError() changed an unrelated error to %v", err)
+	}
+}
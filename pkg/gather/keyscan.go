@@ -0,0 +1,240 @@
+package gather
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+// ScanAlgorithms are the host key algorithms a key scan asks every device
+// for, one connection each, as far as the device's Algorithms offer them.
+// Devices with algorithms other than DefaultAlgorithmProfile are also
+// asked for the other plain key algorithms they offer, such as ssh-dss.
+var ScanAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA,
+}
+
+// How a scanned host key compares with the known_hosts file.
+const (
+	KeyMatch   = "match"
+	KeyNew     = "new"
+	KeyChanged = "changed"
+	KeyRevoked = "revoked"
+)
+
+// ScannedKey is a host key offered by a device.
+type ScannedKey struct {
+	Key ssh.PublicKey
+
+	// Status is KeyMatch, KeyNew, KeyChanged or KeyRevoked.
+	Status string
+
+	// Known holds the line that matched when Status is KeyMatch, the
+	// keys of the same type known_hosts has for the device when it is
+	// KeyChanged, or the revoked key when it is KeyRevoked.
+	Known []kh.KnownKey
+}
+
+// HostKeys holds the host keys offered by a device, or the error that
+// stopped the scan of it.
+type HostKeys struct {
+	Device Device
+	Keys   []ScannedKey
+	Err    error
+}
+
+// errKeyScanned aborts the handshake once the host key has been seen.
+var errKeyScanned = errors.New("host key scanned")
+
+// ScanHostKeys connects to every device once per host key algorithm
+// scanned for, without authenticating, and compares each host key
+// offered with Options.KnownHostsFiles. With no known_hosts file every key
+// is new. Jump hosts are authenticated to with Credentials as in Stream.
+// The results are ordered by device ID.
+func (r *Runner) ScanHostKeys(ctx context.Context) ([]HostKeys, error) {
+	if r.Options.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Options.Deadline)
+		defer cancel()
+	}
+
+	if err := r.resolveDevices(); err != nil {
+		return nil, err
+	}
+
+	sshConfig, err := r.buildSSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	checker := r.checker
+	if checker == nil {
+		checker, err = r.hostKeyChecker()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth := newAuthenticator(r.Credentials, r.Options.Debug)
+	defer auth.Close()
+
+	r.limiter = newRateLimiter(r.Options.DialRate)
+	r.jumps = newJumpPool()
+	defer r.jumps.Close()
+
+	var mutex sync.Mutex
+	var scans []HostKeys
+	add := func(scan HostKeys) {
+		mutex.Lock()
+		scans = append(scans, scan)
+		mutex.Unlock()
+	}
+
+	r.forEachDevice(ctx, func(device Device) {
+		add(r.scanDevice(ctx, device, checker, sshConfig, auth))
+	}, func(device Device, err error) {
+		add(HostKeys{Device: device, Err: err})
+	})
+
+	sort.Slice(scans, func(i, j int) bool {
+		return scans[i].Device.ID < scans[j].Device.ID
+	})
+
+	return scans, nil
+}
+
+// scanDevice collects the host keys device offers for each host key
+// algorithm scanned for. Algorithms the device does not support are
+// skipped. sshConfig and auth are used to connect to its jump hosts.
+func (r *Runner) scanDevice(runCtx context.Context, device Device, checker *kh.Checker, sshConfig *ssh.ClientConfig, auth *authenticator) HostKeys {
+	scan := HostKeys{Device: device}
+
+	ctx := runCtx
+	if r.Options.DeviceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(runCtx, r.Options.DeviceTimeout)
+		defer cancel()
+	}
+
+	platform, err := r.platform(device)
+	if err != nil {
+		scan.Err = err
+		return scan
+	}
+	algorithms, err := r.algorithms(device, platform)
+	if err != nil {
+		scan.Err = err
+		return scan
+	}
+
+	for _, algorithm := range scanAlgorithms(algorithms) {
+		var scanned *ScannedKey
+		config := &ssh.ClientConfig{
+			Timeout: r.dialTimeout(),
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				known, err := checker.Check(hostname, remote, key)
+				scanned = compareHostKey(key, known, err)
+				return errKeyScanned
+			},
+		}
+		algorithms.apply(config)
+		config.HostKeyAlgorithms = []string{algorithm}
+
+		client, _, err := r.dialDevice(ctx, device, config, sshConfig, auth, nil)
+		if client != nil {
+			client.Close()
+		}
+
+		if scanned != nil {
+			scan.Keys = append(scan.Keys, *scanned)
+			continue
+		}
+		if hostKeyAlgorithmUnsupported(err) {
+			continue
+		}
+
+		if ctxErr := r.contextError(runCtx, ctx); ctxErr != nil {
+			err = ctxErr
+		}
+		scan.Err = err
+		break
+	}
+
+	return scan
+}
+
+// scanAlgorithms returns the host key algorithms to scan for with
+// algorithms, as described for ScanAlgorithms.
+func scanAlgorithms(algorithms Algorithms) []string {
+	var scan []string
+	for _, algorithm := range ScanAlgorithms {
+		if containsString(algorithms.HostKeyAlgorithms, algorithm) {
+			scan = append(scan, algorithm)
+		}
+	}
+
+	if algorithms.Profile == DefaultAlgorithmProfile && len(scan) > 0 {
+		return scan
+	}
+	for _, algorithm := range algorithms.HostKeyAlgorithms {
+		if !strings.Contains(algorithm, "-cert-") && !containsString(scan, algorithm) {
+			scan = append(scan, algorithm)
+		}
+	}
+	return scan
+}
+
+// hostKeyAlgorithmUnsupported reports whether err only says that the
+// device has no key for the host key algorithm asked for.
+func hostKeyAlgorithmUnsupported(err error) bool {
+	var algErr *AlgorithmError
+	if !errors.As(err, &algErr) {
+		return false
+	}
+	for _, m := range algErr.Mismatches {
+		if m.What != "host key" {
+			return false
+		}
+	}
+	return true
+}
+
+// compareHostKey turns the result of checking key against known_hosts
+// into a ScannedKey.
+func compareHostKey(key ssh.PublicKey, known *kh.KnownKey, err error) *ScannedKey {
+	scanned := &ScannedKey{Key: key, Status: KeyMatch}
+
+	switch err := err.(type) {
+	case nil:
+		if known != nil {
+			scanned.Known = []kh.KnownKey{*known}
+		}
+	case *kh.RevokedError:
+		scanned.Status = KeyRevoked
+		scanned.Known = []kh.KnownKey{err.Revoked}
+	case *kh.KeyError:
+		// A key of a type known_hosts has nothing for is new even if
+		// the host has keys of other types there.
+		scanned.Status = KeyNew
+		for _, known := range err.Want {
+			if known.Key.Type() == key.Type() {
+				scanned.Status = KeyChanged
+				scanned.Known = append(scanned.Known, known)
+			}
+		}
+	default:
+		scanned.Status = KeyNew
+	}
+
+	return scanned
+}
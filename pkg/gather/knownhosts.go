@@ -0,0 +1,132 @@
+package gather
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+// knownHostsWriter appends host keys trusted on first use to a known_hosts
+// file. Appends are serialized within the process by a mutex and across
+// processes by a lock on the file.
+type knownHostsWriter struct {
+	mutex    sync.Mutex
+	filename string
+	hash     bool
+}
+
+// add appends a line trusting key for address, a host:port, unless the
+// file already trusts it. The file is read again under the lock, so keys
+// added since the run started, by this process or another, are seen. If
+// it has a different key for address, add fails with a *kh.KeyError
+// listing it: a key of any type when anyType is set, as for the host key
+// checks, else only one of the same type. added reports whether a line
+// was written.
+func (w *knownHostsWriter) add(address string, key ssh.PublicKey, anyType bool) (added bool, err error) {
+	host := kh.Normalize(address)
+	if w.hash {
+		host = kh.HashHostname(host)
+	}
+	line := kh.Line([]string{host}, key) + "\n"
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	unlock, err := kh.LockHostKeyDB(w.filename)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(w.filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	db, err := kh.ReadHostKeyDB(f, w.filename)
+	if err != nil {
+		return false, err
+	}
+	keyErr := &kh.KeyError{}
+	for _, known := range db.Lookup(address) {
+		switch {
+		case known.Marker == "@revoked" && keysEqual(known.Key, key):
+			return false, &kh.RevokedError{Revoked: known.KnownKey}
+		case known.Marker != "":
+		case keysEqual(known.Key, key):
+			return false, nil
+		case anyType || known.Key.Type() == key.Type():
+			keyErr.Want = append(keyErr.Want, known.KnownKey)
+		}
+	}
+	if len(keyErr.Want) > 0 {
+		return false, keyErr
+	}
+
+	// Start on a line of our own if the file does not end with one.
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil && err != io.EOF {
+			return false, err
+		}
+		if last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+
+	if _, err := f.WriteString(line); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// acceptNew wraps check so that hosts with no known key have the key they
+// offer appended to the known_hosts file and accepted. Mismatched and
+// revoked keys are still rejected, including those that differ from a key
+// accepted earlier in the run. trusted, if not nil, is called with every
+// key appended this way.
+func (w *knownHostsWriter) acceptNew(check ssh.HostKeyCallback, trusted func(ssh.PublicKey)) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		if keyErr, ok := err.(*kh.KeyError); !ok || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		added, err := w.add(hostname, key, true)
+		switch err.(type) {
+		case nil:
+		case *kh.KeyError, *kh.RevokedError:
+			return err
+		default:
+			return fmt.Errorf("recording host key: %v", err)
+		}
+		if added && trusted != nil {
+			trusted(key)
+		}
+
+		return nil
+	}
+}
+
+// AddKnownHost appends a line trusting key for address, a host:port, to the
+// known_hosts file filename, hashing the host name if hash is set. Nothing
+// is written if the file already trusts key for address; if it has another
+// key of the same type for address, AddKnownHost fails with a
+// *knownhosts.KeyError.
+func AddKnownHost(filename, address string, key ssh.PublicKey, hash bool) error {
+	w := &knownHostsWriter{filename: filename, hash: hash}
+	_, err := w.add(address, key, false)
+	return err
+}
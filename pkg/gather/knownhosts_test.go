@@ -0,0 +1,275 @@
+package gather
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+func newTestECDSAKey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readFile(t *testing.T, filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestKnownHostsWriterAdd(t *testing.T) {
+	key, other := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	ecdsaKey := newTestECDSAKey(t)
+	line := func(address string, key ssh.PublicKey) string {
+		return kh.Line([]string{address}, key) + "\n"
+	}
+	revoked := func(key ssh.PublicKey) string {
+		return "@revoked " + line("*", key)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		address string
+		key     ssh.PublicKey
+		anyType bool
+		added   bool
+		wantErr interface{}
+		want    string
+	}{
+		{
+			name:    "new file",
+			address: "router1:22",
+			key:     key,
+			added:   true,
+			want:    line("router1", key),
+		},
+		{
+			name:    "unknown host",
+			file:    "# comment\n" + line("router2", other),
+			address: "router1:2222",
+			key:     key,
+			added:   true,
+			want:    "# comment\n" + line("router2", other) + line("[router1]:2222", key),
+		},
+		{
+			name:    "no trailing newline",
+			file:    strings.TrimSuffix(line("router2", other), "\n"),
+			address: "router1:22",
+			key:     key,
+			added:   true,
+			want:    line("router2", other) + line("router1", key),
+		},
+		{
+			name:    "already known",
+			file:    line("router1,10.0.0.1", key),
+			address: "router1:22",
+			key:     key,
+			want:    line("router1,10.0.0.1", key),
+		},
+		{
+			name:    "known through a wildcard",
+			file:    line("*.lab", key),
+			address: "core1.lab:22",
+			key:     key,
+			want:    line("*.lab", key),
+		},
+		{
+			name:    "mismatch",
+			file:    line("router1", other),
+			address: "router1:22",
+			key:     key,
+			wantErr: &kh.KeyError{},
+			want:    line("router1", other),
+		},
+		{
+			name:    "other type",
+			file:    line("router1", ecdsaKey),
+			address: "router1:22",
+			key:     key,
+			added:   true,
+			want:    line("router1", ecdsaKey) + line("router1", key),
+		},
+		{
+			name:    "other type with anyType",
+			file:    line("router1", ecdsaKey),
+			address: "router1:22",
+			key:     key,
+			anyType: true,
+			wantErr: &kh.KeyError{},
+			want:    line("router1", ecdsaKey),
+		},
+		{
+			name:    "revoked",
+			file:    revoked(key),
+			address: "router1:22",
+			key:     key,
+			wantErr: &kh.RevokedError{},
+			want:    revoked(key),
+		},
+		{
+			name:    "other key revoked",
+			file:    revoked(other),
+			address: "router1:22",
+			key:     key,
+			added:   true,
+			want:    revoked(other) + line("router1", key),
+		},
+	}
+
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+		if test.file != "" {
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filename, []byte(test.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := &knownHostsWriter{filename: filename}
+		added, err := w.add(test.address, test.key, test.anyType)
+		switch test.wantErr.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		case *kh.KeyError:
+			if keyErr, ok := err.(*kh.KeyError); !ok || len(keyErr.Want) == 0 {
+				t.Errorf("%s: error = %v, want a *knownhosts.KeyError listing the known key", test.name, err)
+			}
+		case *kh.RevokedError:
+			if _, ok := err.(*kh.RevokedError); !ok {
+				t.Errorf("%s: error = %v, want a *knownhosts.RevokedError", test.name, err)
+			}
+		}
+		if added != test.added {
+			t.Errorf("%s: added = %v, want %v", test.name, added, test.added)
+		}
+		if got := readFile(t, filename); got != test.want {
+			t.Errorf("%s: file\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestKnownHostsWriterHash(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+
+	w := &knownHostsWriter{filename: filename, hash: true}
+	for i := 0; i < 2; i++ {
+		if _, err := w.add("router1:2222", key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := readFile(t, filename)
+	if strings.Count(data, "\n") != 1 || !strings.HasPrefix(data, "|1|") || strings.Contains(data, "router1") {
+		t.Errorf("file %q, want a single hashed line", data)
+	}
+
+	db, err := kh.LoadHostKeyDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.Lookup("router1:2222"); len(keys) != 1 {
+		t.Errorf("hashed line matches router1:2222 %d times, want once", len(keys))
+	}
+}
+
+func TestKnownHostsWriterConcurrent(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+
+	// Several writers stand for separate gather processes, sharing only
+	// the file lock.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	added := 0
+	for i := 0; i < 8; i++ {
+		w := &knownHostsWriter{filename: filename}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := w.add("router1:22", key, true)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mutex.Lock()
+				added++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 {
+		t.Errorf("%d writers added the key, want 1", added)
+	}
+	if data := readFile(t, filename); strings.Count(data, "\n") != 1 {
+		t.Errorf("file %q, want a single line", data)
+	}
+}
+
+func TestKnownHostsWriterAcceptNew(t *testing.T) {
+	key, other := newTestSigner(t).PublicKey(), newTestSigner(t).PublicKey()
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	// The check was loaded before the run, so it never sees new keys.
+	check := func(string, net.Addr, ssh.PublicKey) error {
+		return &kh.KeyError{}
+	}
+
+	var trusted []ssh.PublicKey
+	w := &knownHostsWriter{filename: filename}
+	callback := w.acceptNew(check, func(key ssh.PublicKey) {
+		trusted = append(trusted, key)
+	})
+
+	if err := callback("router1:22", remote, key); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+	if err := callback("router1:22", remote, key); err != nil {
+		t.Errorf("same key again: %v", err)
+	}
+	if err := callback("router1:22", remote, other); err == nil {
+		t.Errorf("a different key was accepted after the first")
+	}
+	if len(trusted) != 1 {
+		t.Errorf("%d keys reported trusted, want 1", len(trusted))
+	}
+	if data := readFile(t, filename); strings.Count(data, "\n") != 1 {
+		t.Errorf("file %q, want a single line", data)
+	}
+
+	mismatch := func(string, net.Addr, ssh.PublicKey) error {
+		return &kh.KeyError{Want: []kh.KnownKey{{Key: other}}}
+	}
+	if err := w.acceptNew(mismatch, nil)("router2:22", remote, key); err == nil {
+		t.Errorf("a mismatched key was accepted")
+	}
+}
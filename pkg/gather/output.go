@@ -0,0 +1,312 @@
+package gather
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FormatNDJSON writes one JSON record per line. NewFormatWriter also
+// understands FormatText and FormatJSON.
+const FormatNDJSON = "ndjson"
+
+// ResultWriter receives each device's result as soon as the device is
+// done. Runner serialises calls to WriteResult.
+type ResultWriter interface {
+	WriteResult(Result) error
+}
+
+// resultCollector keeps every result in memory.
+type resultCollector struct {
+	results []Result
+}
+
+func (c *resultCollector) WriteResult(result Result) error {
+	c.results = append(c.results, result)
+	return nil
+}
+
+// Record is the JSON form of a single command run on a single device.
+type Record struct {
+	Device     string    `json:"device"`
+	Address    string    `json:"address"`
+	Platform   string    `json:"platform,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	KnownHost  string    `json:"known_host,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Command    string    `json:"command"`
+	Status     string    `json:"status"`
+	Stdout     string    `json:"stdout"`
+	Stderr     string    `json:"stderr"`
+	ExitStatus *int      `json:"exit_status"`
+	ExitSignal string    `json:"exit_signal,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Records returns one Record per command in result.
+func Records(result Result) []Record {
+	var records []Record
+	for _, output := range result.Outputs {
+		record := Record{
+			Device:     result.Device.Name(),
+			Address:    result.Device.DialAddress(),
+			Platform:   result.Device.Platform,
+			Tags:       result.Device.Tags,
+			Attempts:   result.Attempts,
+			Command:    output.Command,
+			Status:     output.Status,
+			Stdout:     output.Stdout,
+			Stderr:     output.Stderr,
+			ExitSignal: output.ExitSignal,
+			ErrorClass: ErrorClass(output.Err),
+			Start:      output.Start.UTC(),
+			End:        output.End.UTC(),
+			DurationMS: output.End.Sub(output.Start).Milliseconds(),
+		}
+
+		if output.ExitStatus >= 0 {
+			exitStatus := output.ExitStatus
+			record.ExitStatus = &exitStatus
+		}
+		if output.Err != nil {
+			record.Error = output.Err.Error()
+		}
+		if known := result.KnownHost; known != nil {
+			record.KnownHost = fmt.Sprintf("%s:%d", known.Filename, known.Line)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// block locates one device's output within a file written by a
+// StreamWriter.
+type block struct {
+	id     int
+	offset int64
+	length int64
+}
+
+// StreamWriter writes each result to an underlying writer in a single
+// call as soon as it arrives, so a run that stops early leaves every
+// device finished so far intact. It remembers where each device was
+// written so that the file can be put back in device ID order afterwards
+// with Reorder.
+type StreamWriter struct {
+	w      io.Writer
+	encode func(Result) []byte
+
+	// header and footer enclose the results, which are joined by
+	// separator.
+	header, separator, footer string
+
+	started bool
+	offset  int64
+	blocks  []block
+}
+
+// NewTextWriter returns a StreamWriter writing one
+// "host | command | line" record per line of command output. Lines of
+// standard error follow those of standard output prefixed with
+// "stderr: ", and a command that failed ends with its error.
+func NewTextWriter(w io.Writer, separator string) *StreamWriter {
+	return &StreamWriter{
+		w: w,
+		encode: func(result Result) []byte {
+			var b bytes.Buffer
+			for _, output := range result.Outputs {
+				for _, line := range textLines(output) {
+					fmt.Fprintf(&b, "%s %s %s %s %s\n", result.Device.Name(), separator, output.Command, separator, line)
+				}
+			}
+			return b.Bytes()
+		},
+	}
+}
+
+func textLines(output Output) []string {
+	var lines []string
+
+	scanner := bufio.NewScanner(strings.NewReader(output.Stdout))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	scanner = bufio.NewScanner(strings.NewReader(output.Stderr))
+	for scanner.Scan() {
+		lines = append(lines, "stderr: "+scanner.Text())
+	}
+
+	if output.Err != nil {
+		lines = append(lines, output.Err.Error())
+	}
+
+	return lines
+}
+
+// NewJSONWriter returns a StreamWriter writing a JSON array of Records.
+// The array is only complete once Close has been called.
+func NewJSONWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{
+		w: w,
+		encode: func(result Result) []byte {
+			var lines [][]byte
+			for _, record := range Records(result) {
+				line, _ := json.Marshal(record)
+				lines = append(lines, line)
+			}
+			return bytes.Join(lines, []byte(",\n"))
+		},
+		header:    "[\n",
+		separator: ",\n",
+		footer:    "\n]\n",
+	}
+}
+
+// NewNDJSONWriter returns a StreamWriter writing one JSON Record per line.
+func NewNDJSONWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{
+		w: w,
+		encode: func(result Result) []byte {
+			var b bytes.Buffer
+			for _, record := range Records(result) {
+				line, _ := json.Marshal(record)
+				b.Write(line)
+				b.WriteByte('\n')
+			}
+			return b.Bytes()
+		},
+	}
+}
+
+// NewFormatWriter returns the StreamWriter for format, which is one of
+// FormatText, FormatJSON or FormatNDJSON. The separator is only used by
+// the text format.
+func NewFormatWriter(w io.Writer, format string, separator string) (*StreamWriter, error) {
+	switch format {
+	case FormatText:
+		return NewTextWriter(w, separator), nil
+	case FormatJSON:
+		return NewJSONWriter(w), nil
+	case FormatNDJSON:
+		return NewNDJSONWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// WriteResult implements ResultWriter.
+func (s *StreamWriter) WriteResult(result Result) error {
+	data := s.encode(result)
+	if len(data) == 0 {
+		return nil
+	}
+
+	var prefix string
+	if !s.started {
+		prefix = s.header
+	} else {
+		prefix = s.separator
+	}
+
+	n, err := io.WriteString(s.w, prefix+string(data))
+	if n > len(prefix) {
+		s.blocks = append(s.blocks, block{
+			id:     result.Device.ID,
+			offset: s.offset + int64(len(prefix)),
+			length: int64(n - len(prefix)),
+		})
+	}
+	s.offset += int64(n)
+	s.started = true
+
+	return err
+}
+
+// Close finishes the output. It does not close the underlying writer.
+func (s *StreamWriter) Close() error {
+	var tail string
+	if !s.started {
+		tail = s.header
+	}
+	tail += s.footer
+
+	n, err := io.WriteString(s.w, tail)
+	s.offset += int64(n)
+	s.started = true
+
+	return err
+}
+
+// Reorder rewrites the named file, which must hold exactly what this
+// StreamWriter wrote and have been closed, so that devices appear in ID
+// order rather than in the order they finished. The file is replaced
+// atomically.
+func (s *StreamWriter) Reorder(filename string) error {
+	blocks := make([]block, len(s.blocks))
+	copy(blocks, s.blocks)
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].id < blocks[j].id
+	})
+
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filename + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = s.copyBlocks(dst, src, blocks)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	src.Close()
+
+	return os.Rename(tmp, filename)
+}
+
+func (s *StreamWriter) copyBlocks(dst io.Writer, src io.ReaderAt, blocks []block) error {
+	if _, err := io.WriteString(dst, s.header); err != nil {
+		return err
+	}
+
+	for i, b := range blocks {
+		if i > 0 {
+			if _, err := io.WriteString(dst, s.separator); err != nil {
+				return err
+			}
+		}
+		// CopyN fails on a file cut short rather than copying less.
+		_, err := io.CopyN(dst, io.NewSectionReader(src, b.offset, b.length), b.length)
+		if err == io.EOF {
+			return fmt.Errorf("output of device %d is cut short", b.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(dst, s.footer)
+	return err
+}
@@ -0,0 +1,196 @@
+package gather
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testResults returns results for devices 0 to 4 in the order they
+// finished. Device 3 has no output at all, so it encodes to nothing.
+func testResults() []Result {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := func(id int, name string, outputs ...Output) Result {
+		for i := range outputs {
+			outputs[i].Start = start
+			outputs[i].End = start.Add(time.Second)
+		}
+		return Result{Device: Device{ID: id, Hostname: name}, Outputs: outputs}
+	}
+
+	return []Result{
+		result(2, "r2", Output{Command: "show version", Stdout: "v2\nline 2\n", Status: StatusOK}),
+		result(3, "r3"),
+		result(0, "r0",
+			Output{Command: "show version", Stdout: "v0\n", Stderr: "warning\n", Status: StatusOK},
+			Output{Command: "show clock", ExitStatus: -1, Err: errors.New("session closed"), Status: StatusError},
+		),
+		result(4, "r4", Output{Command: "show version", Stdout: "v4\n", Status: StatusOK}),
+		result(1, "r1", Output{Command: "show version", Stdout: "v1 | with a separator\n", Status: StatusOK}),
+	}
+}
+
+// writeOutput writes results with a StreamWriter for format into a file in
+// dir, reordering it if reorder is set, and returns the file's contents.
+func writeOutput(t *testing.T, dir, format string, results []Result, reorder bool) string {
+	filename := filepath.Join(dir, "out."+format)
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewFormatWriter(f, format, "|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if err := writer.WriteResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reorder {
+		if err := writer.Reorder(filename); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: Reorder left its temporary file behind", format)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStreamWriterReorder(t *testing.T) {
+	results := testResults()
+	sorted := []Result{results[2], results[4], results[0], results[1], results[3]}
+
+	wantDevices := []string{"r0", "r0", "r1", "r2", "r4"}
+
+	for _, format := range []string{FormatText, FormatJSON, FormatNDJSON} {
+		dir := t.TempDir()
+
+		got := writeOutput(t, dir, format, results, true)
+		want := writeOutput(t, dir, format, sorted, false)
+		if got != want {
+			t.Errorf("%s: reordered output\n%s\nwant\n%s", format, got, want)
+		}
+		if unordered := writeOutput(t, dir, format, results, false); unordered == want {
+			t.Errorf("%s: the results were written in ID order to begin with", format)
+		}
+
+		var devices []string
+		switch format {
+		case FormatText:
+			for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+				devices = append(devices, strings.SplitN(line, " ", 2)[0])
+			}
+			if len(devices) != 7 {
+				t.Errorf("text: %d lines, want 7", len(devices))
+			}
+			devices = uniqueInOrder(devices)
+			if want := []string{"r0", "r1", "r2", "r4"}; !reflect.DeepEqual(devices, want) {
+				t.Errorf("text: devices %v, want %v", devices, want)
+			}
+			continue
+		case FormatJSON:
+			var records []Record
+			if err := json.Unmarshal([]byte(got), &records); err != nil {
+				t.Fatalf("json: reordered output does not parse: %v\n%s", err, got)
+			}
+			for _, record := range records {
+				devices = append(devices, record.Device)
+			}
+		case FormatNDJSON:
+			scanner := bufio.NewScanner(strings.NewReader(got))
+			for scanner.Scan() {
+				var record Record
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatalf("ndjson: line %q does not parse: %v", scanner.Text(), err)
+				}
+				devices = append(devices, record.Device)
+			}
+		}
+		if !reflect.DeepEqual(devices, wantDevices) {
+			t.Errorf("%s: devices %v, want %v", format, devices, wantDevices)
+		}
+	}
+}
+
+func TestStreamWriterReorderEmpty(t *testing.T) {
+	empty := []Result{{Device: Device{ID: 1, Hostname: "r1"}}, {Device: Device{ID: 0, Hostname: "r0"}}}
+
+	for _, results := range [][]Result{nil, empty} {
+		for _, format := range []string{FormatText, FormatJSON, FormatNDJSON} {
+			got := writeOutput(t, t.TempDir(), format, results, true)
+
+			switch format {
+			case FormatJSON:
+				var records []Record
+				if err := json.Unmarshal([]byte(got), &records); err != nil || len(records) != 0 {
+					t.Errorf("json with %d empty results: %q parses to %v, %v; want an empty array", len(results), got, records, err)
+				}
+			default:
+				if got != "" {
+					t.Errorf("%s with %d empty results: %q, want nothing", format, len(results), got)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamWriterReorderChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "out.ndjson")
+
+	var buf bytes.Buffer
+	writer := NewNDJSONWriter(&buf)
+	for _, result := range testResults() {
+		if err := writer.WriteResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file no longer holds everything that was written, so Reorder
+	// must fail and leave it alone.
+	if err := ioutil.WriteFile(filename, buf.Bytes()[:buf.Len()/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Reorder(filename); err == nil || !strings.Contains(err.Error(), "cut short") {
+		t.Errorf("Reorder of a truncated file: error = %v, want one saying it is cut short", err)
+	}
+	if data, _ := ioutil.ReadFile(filename); !bytes.Equal(data, buf.Bytes()[:buf.Len()/2]) {
+		t.Errorf("failed Reorder changed the file")
+	}
+}
+
+func uniqueInOrder(list []string) []string {
+	var unique []string
+	for _, s := range list {
+		if len(unique) == 0 || unique[len(unique)-1] != s {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
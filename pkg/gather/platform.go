@@ -0,0 +1,179 @@
+package gather
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Platform describes how to drive a kind of device: which transport it
+// needs, what its prompts look like and what has to be typed before the
+// user's commands.
+type Platform struct {
+	Name string
+
+	// Transport is used for devices of this platform unless the device
+	// or Options set one.
+	Transport string
+
+	// Prompt matches the last line of output when the device is waiting
+	// for a command. DefaultPromptPattern is used when empty.
+	Prompt string
+
+	// SetupCommands are run after login, and after enable mode has been
+	// entered, to disable paging and widen the terminal.
+	SetupCommands []string
+
+	// Pager matches the "--More--" line shown when output fills a page;
+	// PagerResponse is typed to get the next page.
+	Pager         string
+	PagerResponse string
+
+	// EnableCommand enters privileged mode when the prompt after login
+	// does not match PrivilegedPrompt. EnablePasswordPrompt matches the
+	// line asking for the enable password, which is answered with
+	// Credentials.EnablePassword.
+	EnableCommand        string
+	EnablePasswordPrompt string
+	PrivilegedPrompt     string
+
+	// Algorithms are offered to devices of this platform that do not set
+	// their own, unless Options sets some for the platform.
+	Algorithms Algorithms
+
+	prompt, pager, enablePasswordPrompt, privilegedPrompt *regexp.Regexp
+}
+
+func (p *Platform) compile() error {
+	var err error
+	compile := func(pattern string, fallback string) *regexp.Regexp {
+		if pattern == "" {
+			pattern = fallback
+		}
+		if pattern == "" || err != nil {
+			return nil
+		}
+
+		var re *regexp.Regexp
+		re, err = regexp.Compile(pattern)
+		return re
+	}
+
+	p.prompt = compile(p.Prompt, DefaultPromptPattern)
+	p.pager = compile(p.Pager, "")
+	p.enablePasswordPrompt = compile(p.EnablePasswordPrompt, `(?i)password: ?$`)
+	p.privilegedPrompt = compile(p.PrivilegedPrompt, `# ?$`)
+	if err != nil {
+		return fmt.Errorf("platform %s: %v", p.Name, err)
+	}
+
+	if p.PagerResponse == "" {
+		p.PagerResponse = " "
+	}
+
+	return nil
+}
+
+var (
+	platformsMutex sync.RWMutex
+	platforms      = make(map[string]*Platform)
+)
+
+// RegisterPlatform adds a platform, or replaces the one with the same
+// name, so that devices can select it through their Platform field.
+func RegisterPlatform(p Platform) error {
+	if p.Name == "" {
+		return fmt.Errorf("platform has no name")
+	}
+
+	if err := p.compile(); err != nil {
+		return err
+	}
+
+	platformsMutex.Lock()
+	platforms[p.Name] = &p
+	platformsMutex.Unlock()
+
+	return nil
+}
+
+// LookupPlatform returns the platform registered under name.
+func LookupPlatform(name string) (*Platform, bool) {
+	platformsMutex.RLock()
+	defer platformsMutex.RUnlock()
+
+	p, ok := platforms[name]
+	return p, ok
+}
+
+// PlatformNames returns the names of every registered platform in sorted
+// order.
+func PlatformNames() []string {
+	platformsMutex.RLock()
+	defer platformsMutex.RUnlock()
+
+	var names []string
+	for name := range platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GenericPlatform is used for devices that do not name a platform.
+const GenericPlatform = "generic"
+
+const ciscoPrompt = `^[\w.\-@/:()]{1,63}[>#] ?$`
+
+func init() {
+	for _, p := range []Platform{
+		{
+			Name:  GenericPlatform,
+			Pager: `(?i)-+ ?more.*-+ ?$`,
+		},
+		{
+			Name:      "linux",
+			Transport: TransportExec,
+		},
+		{
+			Name:                 "cisco_ios",
+			Transport:            TransportShell,
+			Prompt:               ciscoPrompt,
+			SetupCommands:        []string{"terminal length 0", "terminal width 511"},
+			Pager:                ` ?--More-- ?$`,
+			EnableCommand:        "enable",
+			EnablePasswordPrompt: `(?i)password: ?$`,
+			PrivilegedPrompt:     `# ?$`,
+		},
+		{
+			Name:          "cisco_nxos",
+			Transport:     TransportShell,
+			Prompt:        ciscoPrompt,
+			SetupCommands: []string{"terminal length 0", "terminal width 511"},
+			Pager:         ` ?--More-- ?$`,
+		},
+		{
+			Name:          "juniper_junos",
+			Transport:     TransportShell,
+			Prompt:        `^[\w.\-@/:()]{1,63}[>#%] ?$`,
+			SetupCommands: []string{"set cli screen-length 0", "set cli screen-width 0"},
+			Pager:         `---\(more.*\)--- ?$`,
+		},
+		{
+			Name:                 "arista_eos",
+			Transport:            TransportShell,
+			Prompt:               ciscoPrompt,
+			SetupCommands:        []string{"terminal length 0", "terminal width 32767"},
+			Pager:                ` ?--More-- ?$`,
+			EnableCommand:        "enable",
+			EnablePasswordPrompt: `(?i)password: ?$`,
+			PrivilegedPrompt:     `# ?$`,
+		},
+	} {
+		if err := RegisterPlatform(p); err != nil {
+			panic(err)
+		}
+	}
+}
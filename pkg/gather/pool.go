@@ -0,0 +1,130 @@
+package gather
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tagLimits caps how many devices sharing a tag run at once. A limit keyed
+// by a full tag such as "site=nyc" applies to every device carrying that
+// tag; a limit keyed by a bare name such as "site" applies separately to
+// each value of the "site=<value>" tags.
+type tagLimits struct {
+	limits map[string]int
+	slots  map[string]chan struct{}
+}
+
+func newTagLimits(limits map[string]int, devices []Device) *tagLimits {
+	t := &tagLimits{
+		limits: limits,
+		slots:  make(map[string]chan struct{}),
+	}
+
+	for _, device := range devices {
+		for _, key := range t.keys(device) {
+			if _, ok := t.slots[key]; !ok {
+				t.slots[key] = make(chan struct{}, t.limit(key))
+			}
+		}
+	}
+
+	return t
+}
+
+func (t *tagLimits) limit(key string) int {
+	if n := t.limits[key]; n > 0 {
+		return n
+	}
+	return t.limits[key[:strings.Index(key, "=")]]
+}
+
+// keys returns the limited tags of device in sorted order, so that
+// acquiring them one by one cannot deadlock against another device.
+func (t *tagLimits) keys(device Device) []string {
+	var keys []string
+	for _, tag := range device.Tags {
+		if n, ok := t.limits[tag]; ok && n > 0 {
+			keys = append(keys, tag)
+			continue
+		}
+
+		if i := strings.Index(tag, "="); i != -1 {
+			if n, ok := t.limits[tag[:i]]; ok && n > 0 {
+				keys = append(keys, tag)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// acquire takes a slot for every limited tag of device, giving up and
+// returning the slots already taken if ctx is cancelled first.
+func (t *tagLimits) acquire(ctx context.Context, device Device) error {
+	keys := t.keys(device)
+	for i, key := range keys {
+		select {
+		case t.slots[key] <- struct{}{}:
+		case <-ctx.Done():
+			t.releaseKeys(keys[:i])
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *tagLimits) release(device Device) {
+	t.releaseKeys(t.keys(device))
+}
+
+func (t *tagLimits) releaseKeys(keys []string) {
+	for _, key := range keys {
+		<-t.slots[key]
+	}
+}
+
+// rateLimiter spaces out calls to wait so that at most rate of them
+// return per second. A zero rate never waits.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	l := &rateLimiter{}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return l
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
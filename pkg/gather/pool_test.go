@@ -0,0 +1,163 @@
+package gather
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTagLimitsKeys(t *testing.T) {
+	limits := newTagLimits(map[string]int{
+		"site=nyc": 3,
+		"site":     1,
+		"role":     2,
+		"core":     1,
+		"tier":     0,
+	}, nil)
+
+	tests := []struct {
+		tags []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"site=nyc"}, []string{"site=nyc"}},
+		{[]string{"site=lon"}, []string{"site=lon"}},
+		{[]string{"site"}, []string{"site"}},
+		{[]string{"sites=lon", "site-b=lon"}, nil},
+		{[]string{"core"}, []string{"core"}},
+		{[]string{"core=yes"}, []string{"core=yes"}},
+		{[]string{"tier=1", "vendor=cisco"}, nil},
+		{[]string{"site=nyc", "role=edge", "core"}, []string{"core", "role=edge", "site=nyc"}},
+		{[]string{"role=edge", "role=core"}, []string{"role=core", "role=edge"}},
+	}
+
+	for _, test := range tests {
+		if got := limits.keys(Device{Tags: test.tags}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("keys(%v) = %v, want %v", test.tags, got, test.want)
+		}
+	}
+
+	caps := map[string]int{"site=nyc": 3, "site=lon": 1, "site": 1, "role=edge": 2, "core": 1, "core=yes": 1}
+	for key, want := range caps {
+		if got := limits.limit(key); got != want {
+			t.Errorf("limit(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestTagLimitsConcurrency(t *testing.T) {
+	caps := map[string]int{
+		"site=nyc":  2,
+		"site=lon":  1,
+		"site=sfo":  1,
+		"role=edge": 3,
+		"role=core": 2,
+	}
+
+	// Devices carry overlapping tags in shuffled order, so taking slots
+	// in tag order would deadlock.
+	rng := rand.New(rand.NewSource(1))
+	sites := []string{"site=nyc", "site=lon", "site=sfo"}
+	roles := []string{"role=edge", "role=core"}
+	var devices []Device
+	for i := 0; i < 60; i++ {
+		tags := []string{sites[i%3], roles[i%2], fmt.Sprintf("tier=%d", i%4)}
+		rng.Shuffle(len(tags), func(i, j int) { tags[i], tags[j] = tags[j], tags[i] })
+		devices = append(devices, Device{ID: i, Tags: tags})
+	}
+
+	limits := newTagLimits(map[string]int{"site=nyc": 2, "site": 1, "role": 3, "role=core": 2}, devices)
+
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device Device) {
+			defer wg.Done()
+			if err := limits.acquire(context.Background(), device); err != nil {
+				t.Error(err)
+				return
+			}
+
+			mutex.Lock()
+			for _, key := range limits.keys(device) {
+				running[key]++
+				if running[key] > peak[key] {
+					peak[key] = running[key]
+				}
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			for _, key := range limits.keys(device) {
+				running[key]--
+			}
+			mutex.Unlock()
+
+			limits.release(device)
+		}(device)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("devices deadlocked acquiring their tag limits")
+	}
+
+	for key, max := range caps {
+		if peak[key] > max {
+			t.Errorf("%d devices tagged %s ran at once, want at most %d", peak[key], key, max)
+		}
+		if peak[key] == 0 {
+			t.Errorf("no device tagged %s ran", key)
+		}
+	}
+	if len(peak) != len(caps) {
+		t.Errorf("limited tags %v, want %v", peak, caps)
+	}
+}
+
+func TestTagLimitsCancel(t *testing.T) {
+	a := Device{ID: 0, Tags: []string{"site=nyc", "role=edge"}}
+	b := Device{ID: 1, Tags: []string{"role=edge", "site=lon"}}
+	limits := newTagLimits(map[string]int{"site": 1, "role": 1}, []Device{a, b})
+
+	if err := limits.acquire(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+
+	// b gets site=lon but waits for role=edge, held by a.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limits.acquire(ctx, b); err != context.DeadlineExceeded {
+		t.Fatalf("acquire() while blocked = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := len(limits.slots["site=lon"]); n != 0 {
+		t.Errorf("cancelled acquire kept %d slots of site=lon", n)
+	}
+
+	limits.release(a)
+	if err := limits.acquire(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	limits.release(b)
+	for key, slots := range limits.slots {
+		if len(slots) != 0 {
+			t.Errorf("%d slots of %s still taken", len(slots), key)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package gather
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Dialer opens network connections. *net.Dialer is one; so are the
+// dialers returned by NewProxyDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// ProxyDirect, as a device's Proxy, dials the device directly even when
+// Options.Proxy is set.
+const ProxyDirect = "direct"
+
+// ProxyError reports a failure to connect through a proxy. It is a
+// net.Error, so it is classed with the other dial errors.
+type ProxyError struct {
+	// Proxy is the proxy URL, without its password.
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the proxy took too long.
+func (e *ProxyError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// Temporary is part of net.Error.
+func (e *ProxyError) Temporary() bool {
+	return false
+}
+
+// NewProxyDialer returns a Dialer that connects through the proxy at
+// proxyURL, reaching the proxy itself with forward, or directly if
+// forward is nil. The URL is socks5://[user:password@]host:port for a
+// SOCKS5 proxy that is given IP addresses, resolving host names locally,
+// socks5h:// for one that is given host names to resolve, or
+// http://[user:password@]host:port for an HTTP proxy supporting CONNECT.
+func NewProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy %s: want scheme://host:port", u.Redacted())
+	}
+
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+
+	p := proxy{
+		url:     u.Redacted(),
+		address: u.Host,
+		forward: forward,
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Dialer{proxy: p}, nil
+	case "socks5h":
+		return &socks5Dialer{proxy: p, remoteResolve: true}, nil
+	case "http":
+		return &httpConnectDialer{proxy: p}, nil
+	default:
+		return nil, fmt.Errorf("proxy %s: unsupported scheme %q: want socks5, socks5h or http", u.Redacted(), u.Scheme)
+	}
+}
+
+type proxy struct {
+	url      string
+	address  string
+	username string
+	password string
+	forward  Dialer
+}
+
+// dial connects to the proxy and runs handshake on the connection,
+// closing it if ctx ends first.
+func (p *proxy) dial(ctx context.Context, network string, handshake func(net.Conn) (net.Conn, error)) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, &ProxyError{Proxy: p.url, Err: fmt.Errorf("unsupported network %q", network)}
+	}
+
+	conn, err := p.forward.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, &ProxyError{Proxy: p.url, Err: err}
+	}
+
+	// The connection may be tunnelled and not support deadlines, so
+	// ending the handshake early is left to closing it.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	proxied, err := handshake(conn)
+	close(done)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &ProxyError{Proxy: p.url, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return proxied, nil
+}
+
+// socks5Dialer connects through a SOCKS5 proxy, RFC 1928, authenticating
+// with a user name and password, RFC 1929, when it has them.
+type socks5Dialer struct {
+	proxy
+
+	// remoteResolve has the proxy resolve host names.
+	remoteResolve bool
+}
+
+// SOCKS5 protocol constants.
+const (
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5PasswordAuth   = 2
+	socks5NoAcceptable   = 0xff
+	socks5Connect        = 1
+	socks5IPv4           = 1
+	socks5Domain         = 3
+	socks5IPv6           = 4
+	socks5PasswordAuthV1 = 1
+)
+
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	if net.ParseIP(host) == nil && !d.remoteResolve {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].IP.String()
+	}
+
+	return d.dial(ctx, network, func(conn net.Conn) (net.Conn, error) {
+		if err := d.authenticate(conn); err != nil {
+			return nil, err
+		}
+		return conn, d.connect(conn, host, port)
+	})
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	methods := []byte{socks5NoAuth}
+	if d.username != "" {
+		methods = append(methods, socks5PasswordAuth)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+
+	switch reply[1] {
+	case socks5NoAuth:
+		return nil
+	case socks5PasswordAuth:
+		if d.username == "" {
+			return fmt.Errorf("proxy requires a user name and password")
+		}
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return fmt.Errorf("user name or password too long")
+		}
+
+		req := []byte{socks5PasswordAuthV1, byte(len(d.username))}
+		req = append(req, d.username...)
+		req = append(req, byte(len(d.password)))
+		req = append(req, d.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+		return nil
+	case socks5NoAcceptable:
+		return fmt.Errorf("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+}
+
+func (d *socks5Dialer) connect(conn net.Conn, host string, port int) error {
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	if reply[1] != 0 {
+		msg, ok := socks5Replies[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", reply[1])
+		}
+		return fmt.Errorf("connect to %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), msg)
+	}
+
+	// Skip the bound address and port.
+	var skip int
+	switch reply[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("unknown address type %d", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// httpConnectDialer connects through an HTTP proxy with the CONNECT
+// method, authenticating with Basic authentication when it has a user
+// name.
+type httpConnectDialer struct {
+	proxy
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, func(conn net.Conn) (net.Conn, error) {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		if d.username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("connect to %s: %s", address, resp.Status)
+		}
+
+		// The SSH server speaks first, so its version line may already
+		// be buffered.
+		if reader.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, reader: reader}, nil
+		}
+		return conn, nil
+	})
+}
+
+// bufferedConn reads what a bufio.Reader already holds before reading
+// from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// proxyDialer returns how to open the first connection to device, or to
+// its first jump host: through its proxy, else Options.Proxy, using
+// Options.Dialer to reach the proxy, or the device when there is none.
+// key identifies the route for sharing jump host connections.
+func (r *Runner) proxyDialer(device Device) (dial dialFunc, key string, err error) {
+	dial = directDialer
+	if r.Options.Dialer != nil {
+		dial = r.Options.Dialer.DialContext
+	}
+
+	proxyURL := device.Proxy
+	if proxyURL == "" {
+		proxyURL = r.Options.Proxy
+	}
+	if proxyURL == "" || proxyURL == ProxyDirect {
+		return dial, "", nil
+	}
+
+	d, err := NewProxyDialer(proxyURL, r.Options.Dialer)
+	if err != nil {
+		return nil, "", err
+	}
+	return d.DialContext, proxyURL, nil
+}
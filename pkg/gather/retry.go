@@ -0,0 +1,154 @@
+package gather
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy decides how often a device is dialed again after a
+// connection attempt fails with an error Retryable accepts.
+type RetryPolicy struct {
+	// Attempts is the most connection attempts made per device, like
+	// OpenSSH's ConnectionAttempts; zero or one means no retries.
+	Attempts int
+
+	// Backoff is the wait before the first retry, doubled before each
+	// one after it; zero means DefaultRetryBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between attempts; zero means no cap.
+	MaxBackoff time.Duration
+
+	// Jitter shortens each wait by a random fraction of up to Jitter,
+	// between 0 and 1, so that devices that failed together do not retry
+	// together.
+	Jitter float64
+}
+
+// DefaultRetryBackoff is the wait before the first retry when
+// RetryPolicy.Backoff is zero.
+const DefaultRetryBackoff = time.Second
+
+// delay returns the wait before the given retry, counting from 1.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		d -= time.Duration(jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// Retryable reports whether err, returned by a failed connection
+// attempt, may go away on its own: a refused, reset or timed out dial,
+// directly, through a proxy or through a jump host, a connection
+// dropped during the SSH handshake, or a jump host connection that
+// dropped. Authentication failures, host key
+// failures, algorithm mismatches and bad configuration are permanent.
+func Retryable(err error) bool {
+	var (
+		timeout  *TimeoutError
+		proxyErr *ProxyError
+		dnsErr   *net.DNSError
+		algErr   *AlgorithmError
+		netErr   net.Error
+	)
+
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &timeout):
+		return timeout.Scope == "dial"
+	case errors.As(err, &algErr):
+		return false
+	case strings.Contains(err.Error(), "ssh: handshake failed"):
+		// The SSH library only keeps the text of the underlying error.
+		msg := err.Error()
+		for _, lost := range connectionLost {
+			if strings.Contains(msg, lost) {
+				return true
+			}
+		}
+		return strings.HasSuffix(msg, "EOF")
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// A jump host connection that dropped.
+		return true
+	case errors.As(err, &proxyErr):
+		return errors.As(proxyErr.Err, &netErr) || errors.Is(proxyErr.Err, io.EOF) ||
+			errors.Is(proxyErr.Err, io.ErrUnexpectedEOF)
+	case errors.As(err, &netErr):
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionLost are the messages of the errors seen when a connection
+// is dropped during the SSH handshake, other than EOF.
+var connectionLost = []string{
+	"connection reset by peer",
+	"broken pipe",
+	"use of closed network connection",
+}
+
+// dialDevice connects to device with config, through its proxy and jump
+// hosts, dialing again as Options.Retry allows while the attempts fail
+// with a Retryable error. It returns the number of attempts made.
+// trusted is as for deviceDialer.
+func (r *Runner) dialDevice(ctx context.Context, device Device, config *ssh.ClientConfig, sshConfig *ssh.ClientConfig, auth *authenticator, trusted func(string, ssh.PublicKey)) (*ssh.Client, int, error) {
+	policy := r.Options.Retry
+
+	for attempt := 1; ; attempt++ {
+		dial, err := r.deviceDialer(ctx, device, sshConfig, auth, trusted)
+		if err == nil {
+			err = r.limiter.wait(ctx)
+		}
+		if err == nil {
+			var client *ssh.Client
+			client, err = connectToDevice(ctx, device.DialAddress(), dial, config)
+			if err == nil {
+				return client, attempt, nil
+			}
+		}
+
+		if attempt >= policy.Attempts || ctx.Err() != nil || !Retryable(err) {
+			return nil, attempt, err
+		}
+
+		delay := policy.delay(attempt)
+		if r.Options.Debug {
+			log.Printf("%s: attempt %d failed, retrying in %s: %v", device.Name(), attempt, delay.Round(time.Millisecond), err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempt, err
+		}
+	}
+}
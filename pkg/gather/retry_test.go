@@ -0,0 +1,156 @@
+package gather
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+func TestRetryable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	_, refused := net.Dial("tcp", address)
+	if refused == nil {
+		t.Fatal("dialing a closed port succeeded")
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+	}
+	serverConfig.AddHostKey(newTestSigner(t))
+	_, authFailure := ssh.Dial("tcp", startSSHServer(t, serverConfig), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if authFailure == nil {
+		t.Fatal("logging in with a wrong password succeeded")
+	}
+
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	hostKeyErr := &HostKeyError{Kind: HostKeyMismatch, Key: newTestSigner(t).PublicKey(), Err: &kh.KeyError{}}
+	algErr := &AlgorithmError{
+		Mismatches: []AlgorithmMismatch{{What: "key exchange"}},
+		Err:        errors.New("ssh: handshake failed: ssh: no common algorithm for key exchange; client offered: [curve25519-sha256], server offered: [diffie-hellman-group1-sha1]"),
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", refused, true},
+		{"reset", reset, true},
+		{"dial timeout", &TimeoutError{Scope: "dial", After: time.Second}, true},
+		{"jump host dial timeout", fmt.Errorf("jump host bastion:22: %w", &TimeoutError{Scope: "dial"}), true},
+		{"reset during handshake", errors.New("ssh: handshake failed: read tcp 10.0.0.2:50000->10.0.0.1:22: read: connection reset by peer"), true},
+		{"closed during handshake", errors.New("ssh: handshake failed: EOF"), true},
+		{"closed connection during handshake", errors.New("ssh: handshake failed: write tcp 10.0.0.2:50000->10.0.0.1:22: use of closed network connection"), true},
+		{"jump host dropped", fmt.Errorf("jump host bastion:22: %w", io.EOF), true},
+		{"proxy refused", &ProxyError{Proxy: "socks5://proxy:1080", Err: refused}, true},
+		{"proxy dropped", &ProxyError{Proxy: "http://proxy:3128", Err: io.ErrUnexpectedEOF}, true},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "router1", IsTimeout: true}, true},
+
+		{"nil", nil, false},
+		{"cancelled", context.Canceled, false},
+		{"deadline", fmt.Errorf("dialing: %w", context.DeadlineExceeded), false},
+		{"command timeout", &TimeoutError{Scope: "command", After: time.Second}, false},
+		{"device timeout", &TimeoutError{Scope: "device", After: time.Second}, false},
+		{"run timeout", &TimeoutError{Scope: "run", After: time.Second}, false},
+		{"auth failure", authFailure, false},
+		{"jump host auth failure", fmt.Errorf("jump host bastion:22: %w", authFailure), false},
+		{"host key", hostKeyErr, false},
+		{"jump host host key", fmt.Errorf("jump host bastion:22: %w", hostKeyErr), false},
+		{"algorithms", algErr, false},
+		{"proxy rejected", &ProxyError{Proxy: "socks5://proxy:1080", Err: errors.New("connection not allowed by ruleset")}, false},
+		{"unknown host", &net.DNSError{Err: "no such host", Name: "router1", IsNotFound: true}, false},
+		{"configuration", errors.New("unknown platform \"nope\""), false},
+	}
+
+	for _, test := range tests {
+		if got := Retryable(test.err); got != test.want {
+			t.Errorf("%s: Retryable(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		delays []time.Duration
+	}{
+		{RetryPolicy{}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{
+			RetryPolicy{Backoff: 500 * time.Millisecond, MaxBackoff: 3 * time.Second},
+			[]time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{RetryPolicy{Backoff: 5 * time.Second, MaxBackoff: 2 * time.Second}, []time.Duration{2 * time.Second, 2 * time.Second}},
+		{RetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, []time.Duration{time.Second, 2 * time.Second}},
+	}
+
+	for _, test := range tests {
+		for i, want := range test.delays {
+			if got := test.policy.delay(i + 1); got != want {
+				t.Errorf("%+v: delay(%d) = %s, want %s", test.policy, i+1, got, want)
+			}
+		}
+	}
+
+	if got := (RetryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second}).delay(1000); got != 10*time.Second {
+		t.Errorf("delay(1000) = %s, want the 10s cap", got)
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	tests := []struct {
+		policy   RetryPolicy
+		min, max time.Duration
+	}{
+		{RetryPolicy{Backoff: 4 * time.Second, Jitter: 0.5}, 2 * time.Second, 4 * time.Second},
+		{RetryPolicy{Backoff: 4 * time.Second, MaxBackoff: 6 * time.Second, Jitter: 0.25}, 4500 * time.Millisecond, 6 * time.Second},
+		{RetryPolicy{Backoff: 4 * time.Second, Jitter: 3}, 0, 4 * time.Second},
+	}
+
+	for _, test := range tests {
+		retry := 1
+		if test.policy.MaxBackoff > 0 {
+			retry = 5
+		}
+
+		var lowest, highest time.Duration = test.max, test.min
+		for i := 0; i < 1000; i++ {
+			d := test.policy.delay(retry)
+			if d < test.min || d > test.max {
+				t.Fatalf("%+v: delay(%d) = %s, want %s to %s", test.policy, retry, d, test.min, test.max)
+			}
+			if d < lowest {
+				lowest = d
+			}
+			if d > highest {
+				highest = d
+			}
+		}
+
+		// The jitter should actually spread the delays.
+		if highest-lowest < (test.max-test.min)/2 {
+			t.Errorf("%+v: delays only ranged from %s to %s", test.policy, lowest, highest)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package gather
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+// Credentials are the login details offered to every device.
+type Credentials struct {
+	User     string
+	Password []byte
+
+	// Passphrase decrypts encrypted identity files.
+	Passphrase []byte
+
+	// EnablePassword answers the enable prompt of platforms with a
+	// privileged mode; Password is used when it is empty.
+	EnablePassword []byte
+}
+
+// Options tune how a Runner connects to devices.
+type Options struct {
+	// KnownHostsFiles are the OpenSSH known_hosts files used to verify
+	// host keys, read in order; those that do not exist are skipped.
+	// They are ignored when Insecure is set.
+	KnownHostsFiles []string
+
+	// Auth selects the public key authentication offered to devices
+	// that do not set their own.
+	Auth AuthConfig
+
+	// Transport is how commands are sent to devices that do not set
+	// their own: TransportExec or TransportShell. When empty, the
+	// device's platform decides, falling back to TransportExec.
+	Transport string
+
+	// Platform is the platform of devices that do not name their own;
+	// empty means GenericPlatform.
+	Platform string
+
+	// ProxyJump is the chain of jump hosts devices that do not set their
+	// own are reached through, first hop first; empty means devices are
+	// dialed directly. Each jump host is connected to once per run and
+	// shared by every device behind it.
+	ProxyJump []JumpHost
+
+	// Proxy is the URL of the SOCKS5 or HTTP CONNECT proxy, as taken by
+	// NewProxyDialer, that devices without their own proxy are reached
+	// through, or their first jump host if they have any; empty means
+	// no proxy.
+	Proxy string
+
+	// Dialer, when set, opens the connections otherwise dialed directly:
+	// to the proxy if there is one, else to the device or its first
+	// jump host.
+	Dialer Dialer
+
+	// SSHConfig, when set, fills in the HostName, Port, User,
+	// IdentityFile and ProxyJump of devices and jump hosts from an
+	// OpenSSH client configuration, looked up by hostname, or by
+	// address for devices without one. Values set in the inventory win,
+	// as do ProxyJump and User.
+	SSHConfig *SSHConfig
+
+	// User logs in to devices and jump hosts that do not set their own,
+	// in place of the User their SSHConfig entry gives, as with ssh -l.
+	// Credentials.User is only used where neither gives one.
+	User string
+
+	// Algorithms are offered in the SSH handshake to devices and jump
+	// hosts that do not set their own; the zero value offers those of
+	// DefaultAlgorithmProfile.
+	Algorithms Algorithms
+
+	// PlatformAlgorithms, keyed by platform name, override the
+	// algorithms of the platform's devices that do not set their own.
+	PlatformAlgorithms map[string]*Algorithms
+
+	// KnownHostsStrict fails the run on a malformed line in
+	// KnownHostsFiles instead of skipping the line.
+	KnownHostsStrict bool
+
+	// Insecure disables host key verification.
+	Insecure bool
+
+	// AcceptNew trusts the key offered by a host that has none in
+	// KnownHostsFiles and appends it to the first of them, like OpenSSH's
+	// StrictHostKeyChecking=accept-new. Changed and revoked keys are
+	// still rejected.
+	AcceptNew bool
+
+	// HashKnownHosts hashes the host names of keys appended by AcceptNew.
+	HashKnownHosts bool
+
+	// Concurrency is the number of devices worked on at once; zero means
+	// all of them.
+	Concurrency int
+
+	// TagConcurrency caps the number of devices worked on at once per
+	// tag. A key naming a full tag such as "site=nyc" caps the devices
+	// carrying that tag; a bare key such as "site" caps each distinct
+	// "site=<value>" tag separately.
+	TagConcurrency map[string]int
+
+	// DialRate caps the number of new connections opened per second;
+	// zero means no limit.
+	DialRate float64
+
+	// DialTimeout bounds connecting to a device, SSH handshake included;
+	// zero means DefaultDialTimeout.
+	DialTimeout time.Duration
+
+	// Retry dials devices again after connection attempts that fail
+	// with a Retryable error; the zero value makes a single attempt.
+	// Each attempt gets its own DialTimeout, all within DeviceTimeout.
+	Retry RetryPolicy
+
+	// CommandTimeout bounds each command unless the command sets its own
+	// timeout; zero means no limit.
+	CommandTimeout time.Duration
+
+	// DeviceTimeout bounds all the work on a single device, from dialing
+	// to the last command; zero means no limit.
+	DeviceTimeout time.Duration
+
+	// Deadline bounds the whole run; zero means no limit. Devices and
+	// commands not done in time are recorded with StatusTimeout.
+	Deadline time.Duration
+
+	// GracePeriod is how long commands still running when the run is
+	// cancelled are given to finish before their sessions are closed.
+	GracePeriod time.Duration
+
+	// Debug runs devices one at a time and logs keyboard-interactive
+	// prompts.
+	Debug bool
+}
+
+// Runner runs Commands on every one of Devices.
+type Runner struct {
+	Devices     []Device
+	Commands    []Command
+	Credentials Credentials
+	Options     Options
+
+	// KnownHostsSkipped lists the malformed known_hosts lines skipped
+	// by the last Stream or ScanHostKeys.
+	KnownHostsSkipped []kh.LineError
+
+	mutex    sync.Mutex
+	writer   ResultWriter
+	writeErr error
+	limiter  *rateLimiter
+
+	// devices are Devices with Options.SSHConfig applied.
+	devices []Device
+
+	// identityErrs caches checkIdentityFile while devices are resolved.
+	identityErrs map[string]error
+
+	checker    *kh.Checker
+	knownHosts *knownHostsWriter
+	jumps      *jumpPool
+}
+
+// DefaultDialTimeout bounds connecting to a device when
+// Options.DialTimeout is zero.
+const DefaultDialTimeout = 5 * time.Second
+
+// NewRunner returns a Runner for the given devices and commands.
+func NewRunner(devices []Device, commands []Command, credentials Credentials, options Options) *Runner {
+	return &Runner{
+		Devices:     devices,
+		Commands:    commands,
+		Credentials: credentials,
+		Options:     options,
+	}
+}
+
+// Run connects to every device, runs every command and returns the
+// results ordered by device ID. Failures to connect or to run a command
+// are recorded in the affected outputs rather than returned; the error is
+// only set when the run could not start at all.
+//
+// Cancelling ctx stops new devices and commands from being started;
+// commands already running get Options.GracePeriod to finish. Everything
+// left undone is recorded with StatusCancelled.
+func (r *Runner) Run(ctx context.Context) ([]Result, error) {
+	collector := &resultCollector{}
+	if err := r.Stream(ctx, collector); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(collector.results, func(i, j int) bool {
+		return collector.results[i].Device.ID < collector.results[j].Device.ID
+	})
+
+	return collector.results, nil
+}
+
+// Stream is like Run but hands each device's result to w as soon as the
+// device is done instead of keeping them all in memory, so results arrive
+// in completion order. It returns the first error from w, if any, after
+// every device has been worked on.
+func (r *Runner) Stream(ctx context.Context, w ResultWriter) error {
+	if r.Options.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Options.Deadline)
+		defer cancel()
+	}
+
+	if err := r.resolveDevices(); err != nil {
+		return err
+	}
+
+	sshConfig, err := r.buildSSHConfig()
+	if err != nil {
+		return err
+	}
+
+	auth := newAuthenticator(r.Credentials, r.Options.Debug)
+	defer auth.Close()
+
+	r.writer = w
+	r.writeErr = nil
+	r.limiter = newRateLimiter(r.Options.DialRate)
+	r.jumps = newJumpPool()
+	defer r.jumps.Close()
+
+	r.forEachDevice(ctx, func(device Device) {
+		r.execCommands(ctx, device, sshConfig, auth)
+	}, func(device Device, err error) {
+		result := Result{Device: device}
+		result.fail(r.Commands, err)
+		r.addResult(result)
+	})
+
+	return r.writeErr
+}
+
+// hostsWhitelist returns the dial addresses of every device and jump
+// host, which are the only hosts whose known_hosts lines need loading.
+func (r *Runner) hostsWhitelist() []string {
+	hosts := make([]string, 0, len(r.devices))
+	for _, device := range r.devices {
+		hosts = append(hosts, device.DialAddress())
+	}
+	return append(hosts, r.jumpHostAddresses()...)
+}
+
+// forEachDevice calls work for every device from a pool of
+// Options.Concurrency workers, holding the device's tag limits while it
+// does. Devices that cannot start before ctx is done are handed to skip
+// along with the reason.
+func (r *Runner) forEachDevice(ctx context.Context, work func(Device), skip func(Device, error)) {
+	limits := newTagLimits(r.Options.TagConcurrency, r.devices)
+
+	workers := r.Options.Concurrency
+	if workers <= 0 || workers > len(r.devices) {
+		workers = len(r.devices)
+	}
+	if r.Options.Debug {
+		workers = 1
+	}
+
+	jobs := make(chan Device)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for device := range jobs {
+				if err := limits.acquire(ctx, device); err != nil {
+					skip(device, r.contextError(ctx, nil))
+					continue
+				}
+
+				work(device)
+				limits.release(device)
+			}
+		}()
+	}
+
+	for _, device := range r.devices {
+		jobs <- device
+	}
+	close(jobs)
+
+	wg.Wait()
+}
+
+// contextError explains why runCtx or, if it is still live, the device's
+// devCtx is done.
+func (r *Runner) contextError(runCtx, devCtx context.Context) error {
+	if err := runCtx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			return &TimeoutError{Scope: "run", After: r.Options.Deadline}
+		}
+		return err
+	}
+
+	if devCtx != nil && devCtx.Err() != nil {
+		return &TimeoutError{Scope: "device", After: r.Options.DeviceTimeout}
+	}
+
+	return nil
+}
+
+func (r *Runner) addResult(result Result) {
+	r.mutex.Lock()
+	if err := r.writer.WriteResult(result); err != nil && r.writeErr == nil {
+		r.writeErr = err
+	}
+	r.mutex.Unlock()
+}
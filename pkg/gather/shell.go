@@ -0,0 +1,406 @@
+package gather
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transports select how commands are sent to a device.
+const (
+	// TransportExec runs each command in its own exec channel.
+	TransportExec = "exec"
+
+	// TransportShell starts a single interactive shell on a PTY and types
+	// the commands into it one after another, for devices that reject
+	// exec requests or allow only one channel per login.
+	TransportShell = "shell"
+)
+
+// DefaultPromptPattern matches the last line of output when it is a
+// typical network device or Unix shell prompt, such as "router1#",
+// "switch>", "user@host:~$" or "[user@host ~]$".
+const DefaultPromptPattern = `^[\w.\-@()/:~\[\] ]{0,62}[\w)\]~][>#$%] ?$`
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]|\x1b[()][A-Za-z0-9]`)
+
+// cleanShellOutput drops carriage returns, backspaces and terminal escape
+// sequences.
+func cleanShellOutput(s string) string {
+	s = ansiEscape.ReplaceAllString(s, "")
+	s = strings.Replace(s, "\b", "", -1)
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\r", "", -1)
+}
+
+// shellReader buffers everything a shell prints so that it can be
+// searched for prompts as it arrives.
+type shellReader struct {
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	err    error
+	notify chan struct{}
+}
+
+func newShellReader(r io.Reader) *shellReader {
+	s := &shellReader{notify: make(chan struct{}, 1)}
+	go s.run(r)
+	return s
+}
+
+func (s *shellReader) run(r io.Reader) {
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+
+		s.mutex.Lock()
+		s.buf.Write(chunk[:n])
+		if err != nil {
+			s.err = err
+		}
+		s.mutex.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readUntil waits until match finds what it is looking for in the
+// unread output and returns, and consumes, the output up to the end of
+// the match.
+func (s *shellReader) readUntil(ctx context.Context, match func([]byte) int) ([]byte, error) {
+	for {
+		s.mutex.Lock()
+		if end := match(s.buf.Bytes()); end >= 0 {
+			out := make([]byte, end)
+			copy(out, s.buf.Next(end))
+			s.mutex.Unlock()
+			return out, nil
+		}
+		err := s.err
+		s.mutex.Unlock()
+
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("shell closed before prompt")
+			}
+			return nil, err
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// shell drives an interactive shell, sending commands and splitting the
+// output at each prompt.
+type shell struct {
+	session  *ssh.Session
+	stdin    io.WriteCloser
+	reader   *shellReader
+	platform *Platform
+
+	// base is the device name taken from the first prompt. Later prompts
+	// must start with it, which keeps output lines that merely look like
+	// prompts from ending a command early.
+	base string
+
+	// prompt is the last prompt seen.
+	prompt string
+}
+
+func openShell(client *ssh.Client, platform *Platform) (*shell, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	if err := session.RequestPty("vt100", 0, 511, modes); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.Shell(); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &shell{
+		session:  session,
+		stdin:    stdin,
+		reader:   newShellReader(stdout),
+		platform: platform,
+	}, nil
+}
+
+func (sh *shell) Close() error {
+	return sh.session.Close()
+}
+
+func lastLine(s string) string {
+	return strings.TrimSpace(s[strings.LastIndex(s, "\n")+1:])
+}
+
+// isPrompt reports whether line is the device's prompt.
+func (sh *shell) isPrompt(line string) bool {
+	if line == "" || !sh.platform.prompt.MatchString(line) {
+		return false
+	}
+	return sh.base == "" || strings.HasPrefix(line, sh.base)
+}
+
+// stopAt returns a match function for shellReader.readUntil that stops
+// at a prompt, a pager or, if not nil, a line matching extra.
+func (sh *shell) stopAt(extra *regexp.Regexp) func([]byte) int {
+	return func(buf []byte) int {
+		line := lastLine(cleanShellOutput(string(buf)))
+		pager := sh.platform.pager
+		if sh.isPrompt(line) || (pager != nil && pager.MatchString(line)) || (extra != nil && extra.MatchString(line)) {
+			return len(buf)
+		}
+		return -1
+	}
+}
+
+// waitFor returns the output printed before the next prompt, or before a
+// line matching extra if that comes first, paging through "--More--"
+// prompts along the way. matched reports whether extra was seen.
+func (sh *shell) waitFor(ctx context.Context, extra *regexp.Regexp) (out string, matched bool, err error) {
+	var b strings.Builder
+	afterPager := false
+
+	for {
+		buf, err := sh.reader.readUntil(ctx, sh.stopAt(extra))
+		if err != nil {
+			return b.String(), false, err
+		}
+
+		chunk := cleanShellOutput(string(buf))
+		if afterPager {
+			// Pagers erase their prompt with spaces before the next
+			// page continues on the same line.
+			chunk = strings.TrimLeft(chunk, " ")
+		}
+
+		i := strings.LastIndex(chunk, "\n")
+		b.WriteString(chunk[:i+1])
+		line := strings.TrimSpace(chunk[i+1:])
+
+		if pager := sh.platform.pager; pager != nil && pager.MatchString(line) && !sh.isPrompt(line) {
+			if _, err := io.WriteString(sh.stdin, sh.platform.PagerResponse); err != nil {
+				return b.String(), false, err
+			}
+			afterPager = true
+			continue
+		}
+
+		if extra != nil && extra.MatchString(line) && !sh.isPrompt(line) {
+			return b.String(), true, nil
+		}
+
+		if sh.base == "" {
+			sh.base = promptBase(line)
+		}
+		sh.prompt = line
+
+		return b.String(), false, nil
+	}
+}
+
+// run sends line and returns what the shell printed in response, without
+// the echoed command and the closing prompt.
+func (sh *shell) run(ctx context.Context, line string) (string, error) {
+	if _, err := io.WriteString(sh.stdin, line+"\n"); err != nil {
+		return "", err
+	}
+
+	out, _, err := sh.waitFor(ctx, nil)
+	return stripEcho(out, line), err
+}
+
+// enable enters privileged mode if the platform has one and the shell is
+// not already in it.
+func (sh *shell) enable(ctx context.Context, password []byte) error {
+	p := sh.platform
+	if p.EnableCommand == "" || p.privilegedPrompt.MatchString(sh.prompt) {
+		return nil
+	}
+
+	if _, err := io.WriteString(sh.stdin, p.EnableCommand+"\n"); err != nil {
+		return err
+	}
+
+	_, asked, err := sh.waitFor(ctx, p.enablePasswordPrompt)
+	if err != nil {
+		return err
+	}
+
+	if asked {
+		if _, err := io.WriteString(sh.stdin, string(password)+"\n"); err != nil {
+			return err
+		}
+		if _, asked, err = sh.waitFor(ctx, p.enablePasswordPrompt); err != nil {
+			return err
+		}
+	}
+
+	if asked || !p.privilegedPrompt.MatchString(sh.prompt) {
+		return fmt.Errorf("%s: enable failed", p.Name)
+	}
+
+	return nil
+}
+
+// promptBase returns the device name part of a prompt: "router1" for
+// "router1#" or "router1(config)#", "user@host" for "user@host:~$".
+func promptBase(prompt string) string {
+	if i := strings.IndexAny(prompt, "(:[ ~>#$%"); i != -1 {
+		return prompt[:i]
+	}
+	return prompt
+}
+
+// stripEcho drops the first line of out if it is the command echoed back.
+func stripEcho(out, line string) string {
+	i := strings.Index(out, "\n")
+	if i == -1 {
+		if strings.TrimSpace(out) == strings.TrimSpace(line) {
+			return ""
+		}
+		return out
+	}
+
+	if strings.HasSuffix(strings.TrimSpace(out[:i]), strings.TrimSpace(line)) {
+		return out[i+1:]
+	}
+	return out
+}
+
+// prepareShell waits for the first prompt, enters enable mode and runs the
+// platform's setup commands.
+func (r *Runner) prepareShell(runCtx, devCtx context.Context, sh *shell) error {
+	ctx, cancel := context.WithTimeout(devCtx, r.dialTimeout())
+	defer cancel()
+
+	err := func() error {
+		if _, _, err := sh.waitFor(ctx, nil); err != nil {
+			return err
+		}
+
+		password := r.Credentials.EnablePassword
+		if len(password) == 0 {
+			password = r.Credentials.Password
+		}
+		if err := sh.enable(ctx, password); err != nil {
+			return err
+		}
+
+		for _, command := range sh.platform.SetupCommands {
+			if _, err := sh.run(ctx, command); err != nil {
+				return fmt.Errorf("%s: %v", command, err)
+			}
+		}
+
+		return nil
+	}()
+
+	if err != nil {
+		if ctxErr := r.contextError(runCtx, devCtx); ctxErr != nil {
+			return ctxErr
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("shell not ready within %s: %v", r.dialTimeout(), err)
+		}
+	}
+
+	return err
+}
+
+// runShell runs commands one after another in a single interactive
+// shell driven as platform describes. Once a command fails the shell can
+// no longer be trusted to be in step with the commands, so the remaining
+// ones fail with it.
+func (r *Runner) runShell(runCtx, devCtx context.Context, client *ssh.Client, platform *Platform, commands []Command) []Output {
+	var outputs []Output
+	fail := func(commands []Command, err error) []Output {
+		for _, command := range commands {
+			outputs = append(outputs, errorOutput(command.Line, err))
+		}
+		return outputs
+	}
+
+	sh, err := openShell(client, platform)
+	if err != nil {
+		return fail(commands, err)
+	}
+	defer sh.Close()
+
+	if err := r.prepareShell(runCtx, devCtx, sh); err != nil {
+		return fail(commands, err)
+	}
+
+	for i, command := range commands {
+		if err := r.contextError(runCtx, devCtx); err != nil {
+			return fail(commands[i:], err)
+		}
+
+		ctx, cancel, timeout := r.commandContext(runCtx, devCtx, command)
+
+		output := Output{
+			Command:    command.Line,
+			ExitStatus: -1,
+			Start:      time.Now(),
+		}
+
+		stdout, err := sh.run(ctx, command.Line)
+		if err != nil && ctx.Err() != nil {
+			err = r.commandError(runCtx, devCtx, timeout)
+		}
+		cancel()
+
+		output.Stdout = stdout
+		output.finish(err)
+		outputs = append(outputs, output)
+
+		if err != nil {
+			return fail(commands[i+1:], fmt.Errorf("shell abandoned after %q failed: %v", command.Line, err))
+		}
+	}
+
+	io.WriteString(sh.stdin, "exit\n")
+
+	return outputs
+}
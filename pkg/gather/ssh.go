@@ -0,0 +1,402 @@
+package gather
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	kh "github.com/cburnette/gather/knownhostspatched"
+)
+
+func (r *Runner) execCommands(runCtx context.Context, device Device, sshConfig *ssh.ClientConfig, auth *authenticator) {
+	result := Result{
+		Device:  device,
+		Outputs: []Output{},
+	}
+	defer func() {
+		r.addResult(result)
+	}()
+
+	ctx := runCtx
+	if r.Options.DeviceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(runCtx, r.Options.DeviceTimeout)
+		defer cancel()
+	}
+
+	config := *sshConfig
+	if r.checker != nil {
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			var err error
+			result.KnownHost, err = r.checker.Check(hostname, remote, key)
+			return err
+		}
+	}
+	if r.knownHosts != nil {
+		config.HostKeyCallback = r.knownHosts.acceptNew(config.HostKeyCallback, func(key ssh.PublicKey) {
+			result.NewHostKey = key
+		})
+	}
+	if device.User != "" {
+		config.User = device.User
+	}
+
+	authConfig := r.Options.Auth
+	if device.Auth != nil {
+		authConfig = *device.Auth
+	}
+
+	platform, err := r.platform(device)
+	if err != nil {
+		result.fail(r.Commands, err)
+		return
+	}
+
+	algorithms, err := r.algorithms(device, platform)
+	if err != nil {
+		result.fail(r.Commands, err)
+		return
+	}
+	algorithms.apply(&config)
+
+	var client *ssh.Client
+	config.Auth, err = auth.authMethods(authConfig)
+	if err == nil {
+		client, result.Attempts, err = r.dialDevice(ctx, device, &config, sshConfig, auth, func(address string, key ssh.PublicKey) {
+			if result.NewJumpHostKeys == nil {
+				result.NewJumpHostKeys = make(map[string]ssh.PublicKey)
+			}
+			result.NewJumpHostKeys[address] = key
+		})
+	}
+	if ctxErr := r.contextError(runCtx, ctx); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		result.fail(r.Commands, err)
+		return
+	}
+
+	defer client.Close()
+
+	if r.transport(device, platform) == TransportShell {
+		result.Outputs = r.runShell(runCtx, ctx, client, platform, r.Commands)
+		return
+	}
+
+	for i, command := range r.Commands {
+		if err := r.contextError(runCtx, ctx); err != nil {
+			result.fail(r.Commands[i:], err)
+			return
+		}
+
+		output, dropped := r.runCommand(runCtx, ctx, client, command)
+		result.Outputs = append(result.Outputs, output)
+		if dropped {
+			err := r.contextError(runCtx, ctx)
+			if err == nil {
+				err = fmt.Errorf("connection closed after %q did not stop", command.Line)
+			}
+			result.fail(r.Commands[i+1:], err)
+			return
+		}
+	}
+}
+
+// platform returns the platform device is driven as.
+func (r *Runner) platform(device Device) (*Platform, error) {
+	name := device.Platform
+	if name == "" {
+		name = r.Options.Platform
+	}
+	if name == "" {
+		name = GenericPlatform
+	}
+
+	platform, ok := LookupPlatform(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown platform %q", name)
+	}
+	return platform, nil
+}
+
+// transport returns how commands are sent to device: the device's own
+// transport, else the run's, else the platform's, else TransportExec.
+func (r *Runner) transport(device Device, platform *Platform) string {
+	for _, transport := range []string{device.Transport, r.Options.Transport, platform.Transport} {
+		if transport != "" {
+			return transport
+		}
+	}
+	return TransportExec
+}
+
+// commandContext returns the context command runs under. It ends at
+// once when the command's timeout or the device's budget runs out, but
+// only Options.GracePeriod after the run is cancelled, so that commands
+// already running get a chance to finish.
+func (r *Runner) commandContext(runCtx, devCtx context.Context, command Command) (context.Context, context.CancelFunc, time.Duration) {
+	timeout := r.Options.CommandTimeout
+	if command.Timeout > 0 {
+		timeout = command.Timeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+
+	go func() {
+		select {
+		case <-devCtx.Done():
+			if runCtx.Err() == context.Canceled {
+				grace := time.NewTimer(r.Options.GracePeriod)
+				defer grace.Stop()
+
+				select {
+				case <-grace.C:
+				case <-ctx.Done():
+				}
+			}
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel, timeout
+}
+
+// commandError explains why the context of a command ended early.
+func (r *Runner) commandError(runCtx, devCtx context.Context, timeout time.Duration) error {
+	if err := r.contextError(runCtx, devCtx); err != nil {
+		return err
+	}
+	return &TimeoutError{Scope: "command", After: timeout}
+}
+
+// sessionCloseTimeout is how long a device is given to acknowledge the
+// close of a session whose command ran out of time before the whole
+// connection is dropped.
+const sessionCloseTimeout = time.Second
+
+// runCommand runs command in a new session on client, closing the
+// session if the command's context ends before it does. A device that
+// does not acknowledge the close in time has client closed under it, so
+// that a wedged device cannot hold up the run; dropped reports whether
+// that happened.
+func (r *Runner) runCommand(runCtx, devCtx context.Context, client *ssh.Client, command Command) (output Output, dropped bool) {
+	ctx, cancel, timeout := r.commandContext(runCtx, devCtx, command)
+	defer cancel()
+
+	output = Output{
+		Command:    command.Line,
+		ExitStatus: -1,
+		Start:      time.Now(),
+	}
+
+	// Opening a session and starting the command wait on the device
+	// too, so everything up to the end of the command is done aside.
+	var stdout, stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		session, err := client.NewSession()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer session.Close()
+
+		session.Stdout = &stdout
+		session.Stderr = &stderr
+		if err := session.Start(command.Line); err != nil {
+			done <- err
+			return
+		}
+
+		go func() {
+			<-ctx.Done()
+			session.Close()
+		}()
+		done <- session.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		timer := time.NewTimer(sessionCloseTimeout)
+		select {
+		case <-done:
+		case <-timer.C:
+			client.Close()
+			<-done
+			dropped = true
+		}
+		timer.Stop()
+		err = r.commandError(runCtx, devCtx, timeout)
+	}
+
+	output.Stdout = stdout.String()
+	output.Stderr = stderr.String()
+	if err == nil {
+		// Wait only succeeds on an exit status of zero.
+		output.ExitStatus = 0
+	}
+	output.finish(err)
+
+	return output, dropped
+}
+
+func (r *Runner) buildSSHConfig() (*ssh.ClientConfig, error) {
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	r.checker = nil
+	r.knownHosts = nil
+
+	if !r.Options.Insecure {
+		checker, err := r.hostKeyChecker()
+		if err != nil {
+			return nil, err
+		}
+		r.checker = checker
+		hostKeyCallback = checker.HostKeyCallback()
+
+		if r.Options.AcceptNew && len(r.Options.KnownHostsFiles) > 0 {
+			r.knownHosts = &knownHostsWriter{
+				filename: r.Options.KnownHostsFiles[0],
+				hash:     r.Options.HashKnownHosts,
+			}
+		}
+	}
+
+	user := r.Options.User
+	if user == "" {
+		user = r.Credentials.User
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         r.dialTimeout(),
+	}, nil
+}
+
+// hostKeyChecker loads the known_hosts lines for the run's devices from
+// those of Options.KnownHostsFiles that exist, keeping track of the
+// malformed lines skipped.
+func (r *Runner) hostKeyChecker() (*kh.Checker, error) {
+	var files []string
+	for _, file := range r.Options.KnownHostsFiles {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if r.Options.Debug {
+				log.Printf("known_hosts file %s does not exist (skipped)", file)
+			}
+			continue
+		}
+		files = append(files, file)
+	}
+
+	config := kh.Config{
+		HostWhitelist: r.hostsWhitelist(),
+		Strict:        r.Options.KnownHostsStrict,
+	}
+
+	checker, err := kh.NewChecker(config, files...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.KnownHostsSkipped = checker.Skipped
+	if r.Options.Debug {
+		for i := range checker.Skipped {
+			log.Printf("%v (skipped)", &checker.Skipped[i])
+		}
+	}
+
+	return checker, nil
+}
+
+func (r *Runner) dialTimeout() time.Duration {
+	if r.Options.DialTimeout == 0 {
+		return DefaultDialTimeout
+	}
+	return r.Options.DialTimeout
+}
+
+// connectToDevice dials address with dial and runs the SSH handshake,
+// aborting both if ctx is cancelled or they take longer than
+// sshConfig.Timeout.
+func connectToDevice(ctx context.Context, address string, dial dialFunc, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	dialTimeout := &TimeoutError{Scope: "dial", After: sshConfig.Timeout}
+
+	dialCtx, cancel := context.WithTimeout(ctx, sshConfig.Timeout)
+	conn, err := dial(dialCtx, "tcp", address)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() || dialCtx.Err() == context.DeadlineExceeded {
+			return nil, dialTimeout
+		}
+		return nil, err
+	}
+
+	// Tunnelled connections do not support deadlines, so the timer
+	// below also closes the connection when the handshake overruns.
+	deadline := time.Now().Add(sshConfig.Timeout)
+	conn.SetDeadline(deadline)
+	timer := time.NewTimer(sshConfig.Timeout)
+	defer timer.Stop()
+
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-timer.C:
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	// The handshake error only carries the host key error as text, so
+	// keep hold of it to report it with its type and the key presented.
+	var hostKeyErr error
+	config := *sshConfig
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = hostKeyError(sshConfig.HostKeyCallback(hostname, remote, key), key)
+		return hostKeyErr
+	}
+
+	recorder := &kexInitRecorder{Conn: conn}
+	c, chans, reqs, err := ssh.NewClientConn(recorder, address, &config)
+	if !timer.Stop() && err == nil {
+		// The timer fired just as the handshake finished and may have
+		// closed the connection under it.
+		c.Close()
+		err = dialTimeout
+	}
+	close(handshakeDone)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		if !time.Now().Before(deadline) {
+			return nil, dialTimeout
+		}
+		return nil, algorithmError(err, &config, recorder)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
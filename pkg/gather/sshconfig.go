@@ -0,0 +1,649 @@
+package gather
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConfigMaxDepth bounds nested Include directives, as in OpenSSH.
+const sshConfigMaxDepth = 16
+
+// SSHConfig is an OpenSSH client configuration file such as
+// ~/.ssh/config. Only the settings gather can use are kept: HostName,
+// Port, User, IdentityFile and ProxyJump, under the Host and Match blocks
+// they appear in, with Include files read in place.
+type SSHConfig struct {
+	entries []sshConfigEntry
+}
+
+// SSHHostConfig holds the settings an SSHConfig gives a host. Empty
+// fields were not set.
+type SSHHostConfig struct {
+	HostName string
+	Port     int
+	User     string
+
+	// IdentityFiles have ~ and the %d, %h, %n, %p, %r, %u and %%
+	// tokens expanded, %p and %r standing for the port and user the
+	// configuration itself gives, or 22 and the user looked up.
+	IdentityFiles []string
+
+	// ProxyJump is as written, in ssh -J form or "none".
+	ProxyJump string
+}
+
+type sshConfigEntry struct {
+	// conds are the Host or Match lines the entry is under, outermost
+	// first; the entry applies when all of them match.
+	conds []*sshCondition
+
+	keyword string
+	args    []string
+}
+
+// sshCondition is a Host or Match line.
+type sshCondition struct {
+	// hosts are the patterns of a Host line; criteria are used for a
+	// Match line instead.
+	hosts    []string
+	criteria []sshCriterion
+}
+
+type sshCriterion struct {
+	name   string
+	negate bool
+	arg    string
+}
+
+// LoadSSHConfig reads the OpenSSH client configuration file filename. A
+// missing file gives an empty configuration.
+func LoadSSHConfig(filename string) (*SSHConfig, error) {
+	config := &SSHConfig{}
+	if err := config.load(filename, filepath.Dir(filename), nil, 0); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ReadSSHConfig reads an OpenSSH client configuration from r. Relative
+// Include paths are taken from the directory of filename, which is also
+// used in error messages.
+func ReadSSHConfig(r io.Reader, filename string) (*SSHConfig, error) {
+	config := &SSHConfig{}
+	if err := config.read(r, filename, filepath.Dir(filename), nil, 0); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *SSHConfig) load(filename, dir string, conds []*sshCondition, depth int) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) && depth == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.read(f, filename, dir, conds, depth)
+}
+
+// read appends the entries of a file under the conditions of the Include
+// line it was read for, if any.
+func (c *SSHConfig) read(r io.Reader, filename, dir string, outer []*sshCondition, depth int) error {
+	conds := outer
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err == nil && keyword != "" {
+			conds, err = c.parseLine(keyword, args, dir, outer, conds, depth)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (c *SSHConfig) parseLine(keyword string, args []string, dir string, outer, conds []*sshCondition, depth int) ([]*sshCondition, error) {
+	switch keyword {
+	case "host":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("Host needs at least one pattern")
+		}
+		return appendCondition(outer, &sshCondition{hosts: args}), nil
+	case "match":
+		criteria, err := parseMatchCriteria(args)
+		if err != nil {
+			return nil, err
+		}
+		return appendCondition(outer, &sshCondition{criteria: criteria}), nil
+	case "include":
+		if depth+1 > sshConfigMaxDepth {
+			return nil, fmt.Errorf("Include nested too deeply")
+		}
+		for _, arg := range args {
+			if err := c.include(arg, dir, conds, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	case "port":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("Port needs one value")
+		}
+		if port, err := strconv.Atoi(args[0]); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid Port %q", args[0])
+		}
+		fallthrough
+	case "hostname", "user", "identityfile", "proxyjump":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s needs a value", keyword)
+		}
+		c.entries = append(c.entries, sshConfigEntry{conds: conds, keyword: keyword, args: args})
+	}
+
+	return conds, nil
+}
+
+// appendCondition returns outer followed by cond without sharing the
+// backing array of outer.
+func appendCondition(outer []*sshCondition, cond *sshCondition) []*sshCondition {
+	conds := make([]*sshCondition, 0, len(outer)+1)
+	return append(append(conds, outer...), cond)
+}
+
+// include reads the files matching pattern under conds, so that the
+// blocks of a file included from a Host or Match block only apply where
+// that block does.
+func (c *SSHConfig) include(pattern, dir string, conds []*sshCondition, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := c.load(file, dir, conds, depth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseMatchCriteria(args []string) ([]sshCriterion, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Match needs criteria")
+	}
+
+	var criteria []sshCriterion
+	for i := 0; i < len(args); i++ {
+		criterion := sshCriterion{name: strings.ToLower(args[i])}
+		if strings.HasPrefix(criterion.name, "!") {
+			criterion.negate = true
+			criterion.name = criterion.name[1:]
+		}
+
+		switch criterion.name {
+		case "all", "canonical", "final":
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged":
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("Match %s needs an argument", criterion.name)
+			}
+			i++
+			criterion.arg = args[i]
+		default:
+			return nil, fmt.Errorf("unsupported Match criterion %q", args[i])
+		}
+
+		criteria = append(criteria, criterion)
+	}
+
+	return criteria, nil
+}
+
+// splitSSHConfigLine splits a line into its lower-cased keyword and its
+// arguments, which may be double-quoted. The keyword may be followed by
+// "=" instead of white space.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:i])
+
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexAny(rest, " \t"); end != -1 {
+			arg, rest = rest[:end], rest[end:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+
+	return keyword, args, nil
+}
+
+// Lookup resolves the settings for host as OpenSSH would for
+// "ssh -l user host", or "ssh host" if user is empty: the first value
+// obtained for each setting wins, except IdentityFile which accumulates.
+// User is the configuration's even when user is given, in which case,
+// as for ssh, it is user that should be logged in as. Match exec,
+// localnetwork and tagged never match; canonical and final always do,
+// since the configuration is only read once.
+func (c *SSHConfig) Lookup(host, user string) SSHHostConfig {
+	var hc SSHHostConfig
+	var identityFiles []string
+
+	matched := make(map[*sshCondition]bool)
+	for _, entry := range c.entries {
+		applies := true
+		for _, cond := range entry.conds {
+			m, ok := matched[cond]
+			if !ok {
+				m = cond.match(host, hc.HostName, user, hc.User)
+				matched[cond] = m
+			}
+			if !m {
+				applies = false
+				break
+			}
+		}
+		if !applies {
+			continue
+		}
+
+		value := entry.args[0]
+		switch entry.keyword {
+		case "hostname":
+			if hc.HostName == "" {
+				hc.HostName = strings.NewReplacer("%h", host, "%%", "%").Replace(value)
+			}
+		case "port":
+			if hc.Port == 0 {
+				hc.Port, _ = strconv.Atoi(value)
+			}
+		case "user":
+			if hc.User == "" {
+				hc.User = value
+			}
+		case "identityfile":
+			identityFiles = append(identityFiles, entry.args...)
+		case "proxyjump":
+			if hc.ProxyJump == "" {
+				hc.ProxyJump = value
+			}
+		}
+	}
+
+	for _, file := range identityFiles {
+		file = hc.expandTokens(file, host, user)
+		if !containsString(hc.IdentityFiles, file) {
+			hc.IdentityFiles = append(hc.IdentityFiles, file)
+		}
+	}
+
+	return hc
+}
+
+// match reports whether the condition holds for a connection to host as
+// user, hostName and configUser being what the configuration has set so
+// far.
+func (cond *sshCondition) match(host, hostName, user, configUser string) bool {
+	target := host
+	if hostName != "" {
+		target = hostName
+	}
+	if configUser != "" && user == "" {
+		user = configUser
+	}
+
+	if cond.hosts != nil {
+		return matchPatternList(strings.ToLower(host), cond.hosts, true)
+	}
+
+	for _, criterion := range cond.criteria {
+		var ok bool
+		switch criterion.name {
+		case "all", "canonical", "final":
+			ok = true
+		case "host":
+			ok = matchPatternList(strings.ToLower(target), strings.Split(criterion.arg, ","), true)
+		case "originalhost":
+			ok = matchPatternList(strings.ToLower(host), strings.Split(criterion.arg, ","), true)
+		case "user":
+			ok = matchPatternList(user, strings.Split(criterion.arg, ","), false)
+		case "localuser":
+			ok = matchPatternList(localUser(), strings.Split(criterion.arg, ","), false)
+		}
+		if ok == criterion.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchPatternList reports whether s matches one of patterns and none of
+// those negated with "!".
+func matchPatternList(s string, patterns []string, fold bool) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if fold {
+			pattern = strings.ToLower(pattern)
+		}
+
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+
+		if wildcardMatch(pattern, s) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches s against a pattern where * matches any run of
+// characters and ? any single one.
+func wildcardMatch(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func (hc *SSHHostConfig) expandTokens(file, host, user string) string {
+	hostName := hc.HostName
+	if hostName == "" {
+		hostName = host
+	}
+	port := hc.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	if user == "" {
+		user = hc.User
+	}
+	if user == "" {
+		user = localUser()
+	}
+	home, _ := os.UserHomeDir()
+
+	file = strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", hostName,
+		"%n", host,
+		"%p", strconv.Itoa(port),
+		"%r", user,
+		"%u", localUser(),
+	).Replace(file)
+
+	return expandHome(file)
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return home + path[1:]
+}
+
+func localUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDevices sets r.devices to Devices with Options.SSHConfig
+// applied.
+func (r *Runner) resolveDevices() error {
+	r.devices = r.Devices
+	if r.Options.SSHConfig == nil {
+		return nil
+	}
+
+	r.identityErrs = make(map[string]error)
+	defer func() { r.identityErrs = nil }()
+
+	r.devices = make([]Device, len(r.Devices))
+	for i, device := range r.Devices {
+		resolved, err := r.resolveDevice(device)
+		if err != nil {
+			return fmt.Errorf("%s: %v", device.Name(), err)
+		}
+		r.devices[i] = resolved
+	}
+
+	return nil
+}
+
+// ResolvedDevices returns Devices as they will be connected to, with
+// Options.SSHConfig applied, so that the credentials they call for can be
+// worked out before the run.
+func (r *Runner) ResolvedDevices() ([]Device, error) {
+	if err := r.resolveDevices(); err != nil {
+		return nil, err
+	}
+	return r.devices, nil
+}
+
+// resolveDevice fills in what the inventory leaves unset from the
+// SSHConfig entry for device. A device listed only by an alias that the
+// configuration gives a HostName keeps the alias as its Hostname.
+func (r *Runner) resolveDevice(device Device) (Device, error) {
+	alias := device.Hostname
+	if alias == "" {
+		alias = device.Address
+	}
+
+	user := device.User
+	if user == "" {
+		user = r.Options.User
+	}
+
+	hc := r.lookupSSHConfig(alias, user)
+
+	if hc.HostName != "" {
+		if device.Hostname == "" {
+			device.Hostname, device.Address = device.Address, hc.HostName
+		} else if device.Address == "" {
+			device.Address = hc.HostName
+		}
+	}
+	if device.Port == 0 {
+		device.Port = hc.Port
+	}
+	// As with ssh -l, a user given explicitly beats the configuration,
+	// which beats the run's credentials.
+	if user == "" {
+		device.User = hc.User
+	}
+	if device.Auth == nil {
+		device.Auth = r.sshConfigAuth(hc)
+	}
+
+	hops := device.ProxyJump
+	if hops == nil {
+		hops = r.Options.ProxyJump
+	}
+	if hops == nil && hc.ProxyJump != "" {
+		hops = []JumpHost{}
+		if hc.ProxyJump != "none" {
+			var err error
+			if hops, err = ParseProxyJump(hc.ProxyJump); err != nil {
+				return Device{}, fmt.Errorf("ProxyJump: %v", err)
+			}
+		}
+	}
+	if hops != nil {
+		device.ProxyJump = make([]JumpHost, len(hops))
+		for i, hop := range hops {
+			device.ProxyJump[i] = r.resolveJumpHost(hop)
+		}
+	}
+
+	return device, nil
+}
+
+// resolveJumpHost is resolveDevice for a jump host. The jump host's own
+// ProxyJump is not followed.
+func (r *Runner) resolveJumpHost(hop JumpHost) JumpHost {
+	user := hop.User
+	if user == "" {
+		user = r.Options.User
+	}
+
+	hc := r.lookupSSHConfig(hop.Address, user)
+
+	if hc.HostName != "" {
+		hop.Address = hc.HostName
+	}
+	if hop.Port == 0 {
+		hop.Port = hc.Port
+	}
+	if user == "" {
+		hop.User = hc.User
+	}
+	if hop.Auth == nil {
+		hop.Auth = r.sshConfigAuth(hc)
+	}
+
+	return hop
+}
+
+// lookupSSHConfig looks host up in Options.SSHConfig for user, the user
+// given explicitly if any. When neither user nor the entry names one, it
+// is looked up again for Credentials.User, who will be logged in as, so
+// that Match user and %r see them.
+func (r *Runner) lookupSSHConfig(host, user string) SSHHostConfig {
+	hc := r.Options.SSHConfig.Lookup(host, user)
+	if user == "" && hc.User == "" && r.Credentials.User != "" {
+		hc = r.Options.SSHConfig.Lookup(host, r.Credentials.User)
+		hc.User = ""
+	}
+	return hc
+}
+
+// sshConfigAuth returns Options.Auth with the identity files of hc added,
+// or nil if hc names none. Like OpenSSH, it skips those that do not
+// exist, and so that a key the run has no passphrase for does not stop
+// the password being tried, those that cannot be loaded.
+func (r *Runner) sshConfigAuth(hc SSHHostConfig) *AuthConfig {
+	var files []string
+	for _, file := range hc.IdentityFiles {
+		if err := r.checkIdentityFile(file); err != nil {
+			if r.Options.Debug {
+				log.Printf("ssh config: identity file %s: %v (skipped)", file, err)
+			}
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	auth := r.Options.Auth
+	auth.IdentityFiles = append(append([]string(nil), auth.IdentityFiles...), files...)
+	return &auth
+}
+
+// checkIdentityFile reports why the private key in the named file cannot
+// be loaded with Credentials, if it cannot.
+func (r *Runner) checkIdentityFile(filename string) error {
+	if err, ok := r.identityErrs[filename]; ok {
+		return err
+	}
+
+	pemBytes, err := ioutil.ReadFile(filename)
+	if err == nil {
+		_, err = ssh.ParsePrivateKey(pemBytes)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			if len(r.Credentials.Passphrase) == 0 {
+				err = fmt.Errorf("key is encrypted and no passphrase was given")
+			} else {
+				_, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, r.Credentials.Passphrase)
+			}
+		}
+	}
+
+	if r.identityErrs != nil {
+		r.identityErrs[filename] = err
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package gather
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `
+# Settings for the lab.
+Host core? !core9
+    HostName %h.lab.example.com
+    Port 2222
+    IdentityFile /keys/%r@%h
+
+Host bastion
+    HostName=10.0.0.10
+    User jump
+
+Match host *.lab.example.com user admin
+    IdentityFile "/keys/lab admin"
+
+Host *
+    User ops
+    Port 22
+    IdentityFile /keys/%r
+    ProxyJump bastion
+
+Match host nothing exec "true"
+    User never
+`
+
+func TestSSHConfigLookup(t *testing.T) {
+	config, err := ReadSSHConfig(strings.NewReader(testSSHConfig), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		user string
+		want SSHHostConfig
+	}{
+		{
+			host: "core1",
+			want: SSHHostConfig{
+				HostName:      "core1.lab.example.com",
+				Port:          2222,
+				User:          "ops",
+				IdentityFiles: []string{"/keys/ops@core1.lab.example.com", "/keys/ops"},
+				ProxyJump:     "bastion",
+			},
+		},
+		{
+			host: "core1",
+			user: "admin",
+			want: SSHHostConfig{
+				HostName:      "core1.lab.example.com",
+				Port:          2222,
+				User:          "ops",
+				IdentityFiles: []string{"/keys/admin@core1.lab.example.com", "/keys/lab admin", "/keys/admin"},
+				ProxyJump:     "bastion",
+			},
+		},
+		{
+			host: "core9",
+			want: SSHHostConfig{
+				Port:          22,
+				User:          "ops",
+				IdentityFiles: []string{"/keys/ops"},
+				ProxyJump:     "bastion",
+			},
+		},
+		{
+			host: "BASTION",
+			want: SSHHostConfig{
+				HostName:      "10.0.0.10",
+				Port:          22,
+				User:          "jump",
+				IdentityFiles: []string{"/keys/jump"},
+				ProxyJump:     "bastion",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if got := config.Lookup(test.host, test.user); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Lookup(%q, %q) = %+v, want %+v", test.host, test.user, got, test.want)
+		}
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "lab.conf"), []byte("User lab\nHost *\nPort 2200\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ReadSSHConfig(strings.NewReader("Host lab*\n  Include *.conf\nHost *\n  User other\n"), filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want SSHHostConfig
+	}{
+		{"lab1", SSHHostConfig{User: "lab", Port: 2200}},
+		{"router1", SSHHostConfig{User: "other"}},
+	}
+
+	for _, test := range tests {
+		if got := config.Lookup(test.host, ""); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Lookup(%q) = %+v, want %+v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestReadSSHConfigErrors(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr string
+	}{
+		{"Host\n", "config:1: Host needs at least one pattern"},
+		{"\nPort ssh\n", "config:2: invalid Port"},
+		{"User\n", "config:1: user needs a value"},
+		{"Match\n", "config:1: Match needs criteria"},
+		{"Match user\n", "config:1: Match user needs an argument"},
+		{"Match address 10.0.0.0/8\n", "unsupported Match criterion"},
+		{"User \"ops\n", "config:1:"},
+	}
+
+	for _, test := range tests {
+		_, err := ReadSSHConfig(strings.NewReader(test.config), "config")
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("ReadSSHConfig(%q): error = %v, want %q", test.config, err, test.wantErr)
+		}
+	}
+}
+
+func TestResolveDeviceUser(t *testing.T) {
+	config, err := ReadSSHConfig(strings.NewReader("Host core*\n  User bob\nHost *\n  IdentityFile /nonexistent/%r\n"), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		device      Device
+		optionsUser string
+		credsUser   string
+		wantUser    string
+	}{
+		{Device{Hostname: "core1"}, "", "carol", "bob"},
+		{Device{Hostname: "core1"}, "alice", "carol", ""},
+		{Device{Hostname: "core1", User: "dave"}, "alice", "carol", "dave"},
+		{Device{Hostname: "edge1"}, "", "carol", ""},
+	}
+
+	for _, test := range tests {
+		r := NewRunner([]Device{test.device}, nil, Credentials{User: test.credsUser}, Options{SSHConfig: config, User: test.optionsUser})
+		devices, err := r.ResolvedDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := devices[0].User; got != test.wantUser {
+			t.Errorf("%+v with user %q and credentials user %q: User = %q, want %q", test.device, test.optionsUser, test.credsUser, got, test.wantUser)
+		}
+	}
+}
+
+func TestLookupSSHConfigUser(t *testing.T) {
+	config, err := ReadSSHConfig(strings.NewReader("Match user carol\n  Port 2200\nHost *\n  IdentityFile /keys/%r\n"), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(nil, nil, Credentials{User: "carol"}, Options{SSHConfig: config})
+	want := SSHHostConfig{Port: 2200, IdentityFiles: []string{"/keys/carol"}}
+	if got := r.lookupSSHConfig("core1", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("lookupSSHConfig(core1) with credentials user carol = %+v, want %+v", got, want)
+	}
+
+	want = SSHHostConfig{IdentityFiles: []string{"/keys/alice"}}
+	if got := r.lookupSSHConfig("core1", "alice"); !reflect.DeepEqual(got, want) {
+		t.Errorf("lookupSSHConfig(core1, alice) = %+v, want %+v", got, want)
+	}
+}
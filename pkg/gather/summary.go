@@ -0,0 +1,121 @@
+package gather
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Summary counts devices by the status of their results. It implements
+// ResultWriter so it can be fed alongside an output writer with
+// MultiResultWriter.
+type Summary struct {
+	// NonZeroExitOK counts commands that ran but exited with a non-zero
+	// status or a signal as successful.
+	NonZeroExitOK bool
+
+	Devices   int
+	OK        int
+	Failed    int
+	TimedOut  int
+	Cancelled int
+
+	// NewlyTrusted names the devices whose host keys were trusted on
+	// first use.
+	NewlyTrusted []string
+
+	// NewlyTrustedJumpHosts holds the addresses of the jump hosts whose
+	// host keys were trusted on first use.
+	NewlyTrustedJumpHosts []string
+
+	// Retried names the devices that were dialed more than once.
+	Retried []string
+
+	// HostKeyFailures holds the devices whose host keys failed
+	// verification.
+	HostKeyFailures []HostKeyFailure
+}
+
+// HostKeyFailure is a device whose host key failed verification.
+type HostKeyFailure struct {
+	Device string
+	Err    *HostKeyError
+}
+
+// WriteResult implements ResultWriter.
+func (s *Summary) WriteResult(result Result) error {
+	s.Devices++
+	if result.NewHostKey != nil {
+		s.NewlyTrusted = append(s.NewlyTrusted, result.Device.Name())
+	}
+	for address := range result.NewJumpHostKeys {
+		s.NewlyTrustedJumpHosts = append(s.NewlyTrustedJumpHosts, address)
+	}
+	sort.Strings(s.NewlyTrustedJumpHosts)
+	if result.Attempts > 1 {
+		s.Retried = append(s.Retried, result.Device.Name())
+	}
+	if len(result.Outputs) > 0 {
+		var hostKeyErr *HostKeyError
+		if errors.As(result.Outputs[0].Err, &hostKeyErr) {
+			s.HostKeyFailures = append(s.HostKeyFailures, HostKeyFailure{Device: result.Device.Name(), Err: hostKeyErr})
+		}
+	}
+	switch result.status(s.NonZeroExitOK) {
+	case StatusOK:
+		s.OK++
+	case StatusTimeout:
+		s.TimedOut++
+	case StatusCancelled:
+		s.Cancelled++
+	default:
+		s.Failed++
+	}
+	return nil
+}
+
+func (s *Summary) String() string {
+	summary := fmt.Sprintf("%d devices: %d ok, %d failed, %d timed out, %d cancelled", s.Devices, s.OK, s.Failed, s.TimedOut, s.Cancelled)
+	if len(s.NewlyTrusted) > 0 {
+		summary += fmt.Sprintf("\nnewly trusted host keys: %s", strings.Join(s.NewlyTrusted, ", "))
+	}
+	if len(s.NewlyTrustedJumpHosts) > 0 {
+		summary += fmt.Sprintf("\nnewly trusted jump host keys: %s", strings.Join(s.NewlyTrustedJumpHosts, ", "))
+	}
+	if len(s.Retried) > 0 {
+		summary += fmt.Sprintf("\nretried connections: %s", strings.Join(s.Retried, ", "))
+	}
+	if len(s.HostKeyFailures) > 0 {
+		summary += fmt.Sprintf("\n%d host key failures:", len(s.HostKeyFailures))
+		for _, failure := range s.HostKeyFailures {
+			summary += fmt.Sprintf("\n  %s: %s", failure.Device, failure.Err.Kind)
+			summary += fmt.Sprintf("\n    presented %s", fingerprint(failure.Err.Key))
+			for _, known := range failure.Err.Want {
+				if failure.Err.Kind == HostKeyRevoked {
+					summary += fmt.Sprintf("\n    revoked at %s:%d", known.Filename, known.Line)
+				} else {
+					summary += fmt.Sprintf("\n    expected %s at %s:%d", fingerprint(known.Key), known.Filename, known.Line)
+				}
+			}
+		}
+	}
+	return summary
+}
+
+type multiResultWriter []ResultWriter
+
+func (m multiResultWriter) WriteResult(result Result) error {
+	for _, w := range m {
+		if err := w.WriteResult(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MultiResultWriter returns a ResultWriter that hands every result to each
+// of writers in turn, stopping at the first error.
+func MultiResultWriter(writers ...ResultWriter) ResultWriter {
+	return multiResultWriter(writers)
+}